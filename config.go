@@ -0,0 +1,180 @@
+/*
+config.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+
+*/
+
+package fsock
+
+import (
+	"crypto/tls"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the settings of a FSock, the zero values keep the defaults
+type Config struct {
+	Address        string // [tcp://|tls://|unix://]host[:port], DefaultFSPort if no port
+	Password       string
+	Reconnects     int // -1 for infinite reconnects, 0 for none once connected, the Lazy sockets still connecting on first use
+	EventHandlers  map[string][]func(string, int)
+	EventFilters   map[string][]string
+	Logger         Logger            // no logging if nil
+	ConnIdx        int               // Indetifier for the component using this instance of FSock, optional
+	BgapiSubscribe bool              // Subscribe to BACKGROUND_JOB so SendBgapiCmd receives the outputs
+	Lazy           bool              // Do not connect on construction, only on first command, on ReadEvents or on explicit Connect
+	Labels         map[string]string // Tags shown in Stats and in the log lines
+
+	CmdTimeout        time.Duration // Limits the wait for the replies of the commands sent without a context
+	WriteTimeout      time.Duration // Limits the time a command write can block
+	MaxPendingCmds    int           // Limits the commands waiting for replies at once, see SetMaxPendingCmds
+	MaxInFlight       int           // Limits the commands written and waiting for replies, see SetMaxInFlightCmds
+	MaxReconnectDelay time.Duration // Caps the Fibonacci delays between the reconnect attempts, 0 for no cap
+	LocalAddr         string        // Local address the connections originate from, IP or IP:port
+	TLSConfig         *tls.Config   // Used on tls connections, implies tls for addresses without a scheme
+	Linger            *int          // SO_LINGER seconds of the tcp connections, system default if nil
+
+	Trace               bool // Log at debug level the raw socket I/O
+	MsgURLEncoding      bool // URL-encode the sendmsg header values
+	DefaultEventLock    bool // Send the sendmsg execute commands with event-lock unless set, see SetDefaultEventLock
+	SynchronousDispatch bool // Run the event handlers in order on one dispatching goroutine
+	FrameHistory        int  // Number of frames kept for RecentFrames
+	UndispatchedHistory int  // Number of events without handlers kept for UndispatchedEvents
+	EventReplay         int  // Number of events kept for AddEventHandlerWithReplay
+	EventAllowlist      []string
+	ValidateEventNames  bool // Warn about the subscriptions to event names missing from KnownEventNames
+	TrackEventSequence  bool // Detect the gaps in Event-Sequence, see SetSequenceTracking
+	OnSequenceGap       func(expected, received uint64)
+	EventTransform      func(*Event) *Event // Applied to the events before dispatching them, see SetEventTransform
+	CharsetDecoder      func(string) string // Converts to UTF-8 the values received in other charsets, like DecodeLatin1
+	CharsetHeaders      []string            // Headers decoded by CharsetDecoder, all and the body if empty
+	EventsChanSize      int                 // Buffer of the channel returned by EventsChan, EventsChanBuffer if 0
+	EventsChanDrop      bool                // Drop the events not fitting in the EventsChan buffer instead of blocking
+	EventQueueSize      int                 // Events queued between the reading and the dispatching, see SetEventQueue
+	EventQueuePolicy    EventQueuePolicy    // Applied when the event queue is full
+
+	OnDisconnect       func(connIdx int)
+	OnReconnectAttempt func(attempt int, addr string, err error) // Called after each attempt of the automatic reconnects
+	OtherFrameHandler  func(contentType, header, body string)    // Receives the frames of unknown Content-Type, see SetOtherFrameHandler
+	MaxBodySize        int                                       // Events with bigger bodies are passed to BodyStreamer
+	BodyStreamer       func(headers string, body io.Reader, connIdx int)
+
+	ApiRetries         int      // Retries of the API commands failing with transient errors
+	TransientApiErrors []string // TransientApiErrors package default if empty
+	ApiCacheTTL        time.Duration
+	ApiCacheCmds       []string // API commands whose replies are cached for ApiCacheTTL
+}
+
+// NewFSockFromConfig creates the FSock out of the config, connecting to FS unless cfg.Lazy
+func NewFSockFromConfig(cfg Config) (fsock *FSock, err error) {
+	if cfg.Logger == nil {
+		cfg.Logger = nopLogger{}
+	}
+	var fsnetwork, fsaddr string
+	if fsnetwork, fsaddr, err = parseFSAddress(cfg.Address); err != nil {
+		return
+	}
+	if cfg.TLSConfig != nil && fsnetwork == "tcp" && !strings.Contains(cfg.Address, "://") {
+		fsnetwork = "tls"
+	}
+	fsock = &FSock{
+		fsMutex:         new(sync.RWMutex),
+		connIdx:         cfg.ConnIdx,
+		fsnetwork:       fsnetwork,
+		fsaddress:       fsaddr,
+		fspaswd:         cfg.Password,
+		tlsConfig:       cfg.TLSConfig,
+		eventHandlers:   copyHandlers(cfg.EventHandlers), // copied so the sockets sharing them, like the pooled ones, do not race
+		eventFilters:    copyFilters(cfg.EventFilters),
+		backgroundChans: make(map[string]chan string),
+		reconnects:      cfg.Reconnects,
+		delayFunc:       DelayFunc(),
+		bgapiSubsc:      cfg.BgapiSubscribe,
+		stopReadEvents:  make(chan struct{}),
+		errReadEvents:   make(chan error),
+		closed:          make(chan struct{}),
+		onDisconnect:    cfg.OnDisconnect,
+		onReconnectTry:  cfg.OnReconnectAttempt,
+		replaySize:      cfg.EventReplay,
+		syncDispatch:    cfg.SynchronousDispatch,
+		evQueueSize:     cfg.EventQueueSize,
+		evQueuePolicy:   cfg.EventQueuePolicy,
+		otherFrames:     cfg.OtherFrameHandler,
+		eventTransform:  cfg.EventTransform,
+		charsetDecoder:  cfg.CharsetDecoder,
+		charsetHeaders:  cfg.CharsetHeaders,
+		eventsChanSize:  cfg.EventsChanSize,
+		eventsChanDrop:  cfg.EventsChanDrop,
+		framesSize:      cfg.FrameHistory,
+		deadSize:        cfg.UndispatchedHistory,
+	}
+	fsock.logWriter = cfg.Logger
+	fsock.logger = labeledLogger{Logger: dynLogger(fsock.logOutput), fs: fsock}
+	for key, value := range cfg.Labels {
+		fsock.SetLabel(key, value)
+	}
+	if err = fsock.SetLocalAddr(cfg.LocalAddr); err != nil {
+		return nil, err
+	}
+	if cfg.Linger != nil {
+		fsock.SetLinger(*cfg.Linger)
+	}
+	fsock.SetCmdTimeout(cfg.CmdTimeout)
+	fsock.SetWriteTimeout(cfg.WriteTimeout)
+	fsock.SetMaxPendingCmds(cfg.MaxPendingCmds)
+	fsock.SetMaxInFlightCmds(cfg.MaxInFlight)
+	fsock.SetMaxReconnectDelay(cfg.MaxReconnectDelay)
+	fsock.SetTrace(cfg.Trace)
+	fsock.SetMsgURLEncoding(cfg.MsgURLEncoding)
+	fsock.SetDefaultEventLock(cfg.DefaultEventLock)
+	fsock.SetEventNameValidation(cfg.ValidateEventNames)
+	fsock.SetSequenceTracking(cfg.TrackEventSequence, cfg.OnSequenceGap)
+	if len(cfg.EventAllowlist) != 0 {
+		fsock.SetEventAllowlist(cfg.EventAllowlist...)
+	}
+	if cfg.BodyStreamer != nil {
+		fsock.SetBodyStreamer(cfg.MaxBodySize, cfg.BodyStreamer)
+	}
+	if cfg.ApiRetries != 0 {
+		fsock.SetApiRetries(cfg.ApiRetries, cfg.TransientApiErrors...)
+	}
+	if cfg.ApiCacheTTL != 0 {
+		fsock.SetApiCache(cfg.ApiCacheTTL, cfg.ApiCacheCmds...)
+	}
+	if cfg.Lazy {
+		fsock.lazyConnect = 1
+		return
+	}
+	if err = fsock.Connect(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// copyHandlers returns a deep copy of the event handlers, nil if none
+func copyHandlers(handlers map[string][]func(string, int)) (cp map[string][]func(string, int)) {
+	if handlers == nil {
+		return
+	}
+	cp = make(map[string][]func(string, int), len(handlers))
+	for evName, evHandlers := range handlers {
+		cp[evName] = append([]func(string, int){}, evHandlers...)
+	}
+	return
+}
+
+// copyFilters returns a deep copy of the event filters, nil if none
+func copyFilters(filters map[string][]string) (cp map[string][]string) {
+	if filters == nil {
+		return
+	}
+	cp = make(map[string][]string, len(filters))
+	for hdr, vals := range filters {
+		cp[hdr] = append([]string{}, vals...)
+	}
+	return
+}
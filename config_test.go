@@ -0,0 +1,112 @@
+/*
+config_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+
+*/
+
+package fsock
+
+import (
+	"crypto/tls"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewFSockFromConfig(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockFromConfig(Config{
+		Address:        mFS.Addr(),
+		Password:       "ClueCon",
+		Reconnects:     3,
+		CmdTimeout:     time.Second,
+		EventAllowlist: []string{"CHANNEL_ANSWER"},
+		ApiRetries:     2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if !fs.Connected() {
+		t.Error("expected connected")
+	}
+	if _, isNop := fs.logOutput().(nopLogger); !isNop {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nopLogger{}, fs.logger)
+	}
+	if fs.fsnetwork != "tcp" || fs.reconnects != 3 {
+		t.Errorf("unexpected network <%s> or reconnects <%d>", fs.fsnetwork, fs.reconnects)
+	}
+	if cmdTimeout := time.Duration(atomic.LoadInt64(&fs.cmdTimeout)); cmdTimeout != time.Second {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Second, cmdTimeout)
+	}
+	if writeTimeout := atomic.LoadInt64(&fs.writeTimeout); writeTimeout != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, writeTimeout)
+	}
+	if !reflect.DeepEqual(fs.allowedEvents, map[string]bool{"CHANNEL_ANSWER": true}) {
+		t.Errorf("unexpected allowlist: %+v", fs.allowedEvents)
+	}
+	if fs.apiRetries != 2 || !reflect.DeepEqual(fs.transientErrs, TransientApiErrors) {
+		t.Errorf("unexpected retries <%d> on <%+v>", fs.apiRetries, fs.transientErrs)
+	}
+	if fs.localAddr != nil || fs.tracing() || fs.syncDispatch || fs.apiCacheTTL != 0 {
+		t.Error("expected the other options disabled")
+	}
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "+OK\n", rply)
+	}
+}
+
+func TestNewFSockFromConfigLazy(t *testing.T) {
+	fs, err := NewFSockFromConfig(Config{
+		Address:   "127.0.0.1:1",
+		Lazy:      true,
+		TLSConfig: &tls.Config{ServerName: "fs.example.com"},
+		LocalAddr: "127.0.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Connected() {
+		t.Error("expected not connected")
+	}
+	if fs.fsnetwork != "tls" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "tls", fs.fsnetwork)
+	}
+	if fs.localAddr == nil || fs.localAddr.String() != "127.0.0.1:0" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "127.0.0.1:0", fs.localAddr)
+	}
+
+	if _, err = NewFSockFromConfig(Config{Address: "127.0.0.1", LocalAddr: "invalid:addr:1", Lazy: true}); err == nil {
+		t.Error("expected error for the invalid local address")
+	}
+}
+
+func TestNewFSockFromConfigLazyZeroReconnects(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockFromConfig(Config{Address: mFS.Addr(), Password: "ClueCon", Lazy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "+OK\n", rply)
+	}
+	if accepted := mFS.Accepted(); accepted != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, accepted)
+	}
+}
@@ -0,0 +1,138 @@
+/*
+event.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+
+*/
+
+package fsock
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event is a FreeSWITCH event in plain format, parsed into headers and body
+type Event struct {
+	Name    string            // Event-Name, including the subclass for CUSTOM events
+	Headers map[string]string // url decoded header values
+	Body    string
+}
+
+// NewEvent parses the event as received from FreeSWITCH
+func NewEvent(event string) (ev *Event) {
+	ev = &Event{
+		Name:    eventName(event),
+		Headers: EventToMap(event),
+	}
+	ev.Body = ev.Headers[EventBodyTag]
+	delete(ev.Headers, EventBodyTag)
+	return
+}
+
+// Get returns the value of the header, empty if missing
+func (ev *Event) Get(hdr string) string {
+	return ev.Headers[hdr]
+}
+
+// value returns the value of the header, error if missing
+func (ev *Event) value(hdr string) (string, error) {
+	val, has := ev.Headers[hdr]
+	if !has {
+		return "", fmt.Errorf("Header <%s> missing", hdr)
+	}
+	return val, nil
+}
+
+// GetInt parses the header as integer, like Channel-Read-Codec-Rate
+func (ev *Event) GetInt(hdr string) (i int64, err error) {
+	var val string
+	if val, err = ev.value(hdr); err != nil {
+		return
+	}
+	if i, err = strconv.ParseInt(strings.TrimSpace(val), 10, 64); err != nil {
+		return 0, fmt.Errorf("Cannot parse header <%s> as integer: %w", hdr, err)
+	}
+	return
+}
+
+// GetFloat parses the header as floating point number, like variable_rtp_audio_in_mos
+func (ev *Event) GetFloat(hdr string) (f float64, err error) {
+	var val string
+	if val, err = ev.value(hdr); err != nil {
+		return
+	}
+	if f, err = strconv.ParseFloat(strings.TrimSpace(val), 64); err != nil {
+		return 0, fmt.Errorf("Cannot parse header <%s> as float: %w", hdr, err)
+	}
+	return
+}
+
+// GetBool parses the header as FreeSWITCH does with switch_true and switch_false
+// Besides true and false the values yes, on, enabled, active, allow and the numbers are accepted, case insensitive
+func (ev *Event) GetBool(hdr string) (b bool, err error) {
+	var val string
+	if val, err = ev.value(hdr); err != nil {
+		return
+	}
+	switch strings.ToLower(strings.TrimSpace(val)) {
+	case "true", "t", "yes", "on", "enabled", "active", "allow":
+		return true, nil
+	case "false", "f", "no", "off", "disabled", "inactive", "disallow":
+		return false, nil
+	}
+	var i int64
+	if i, err = strconv.ParseInt(strings.TrimSpace(val), 10, 64); err != nil {
+		return false, fmt.Errorf("Cannot parse header <%s> as boolean: <%s>", hdr, val)
+	}
+	return i != 0, nil
+}
+
+// GetDuration parses the integer header as a number of units, like time.Microsecond for variable_billusec
+// or time.Second for variable_billsec, the values with unit suffix like 1.5s are parsed with time.ParseDuration
+func (ev *Event) GetDuration(hdr string, unit time.Duration) (d time.Duration, err error) {
+	var val string
+	if val, err = ev.value(hdr); err != nil {
+		return
+	}
+	val = strings.TrimSpace(val)
+	if i, errInt := strconv.ParseInt(val, 10, 64); errInt == nil {
+		return time.Duration(i) * unit, nil
+	}
+	if d, err = time.ParseDuration(val); err != nil {
+		return 0, fmt.Errorf("Cannot parse header <%s> as duration: %w", hdr, err)
+	}
+	return
+}
+
+// Timestamp returns the time the event was fired, out of the microseconds since epoch in Event-Date-Timestamp
+func (ev *Event) Timestamp() (t time.Time, err error) {
+	var usec int64
+	if usec, err = ev.GetInt("Event-Date-Timestamp"); err != nil {
+		return
+	}
+	return time.Unix(0, usec*int64(time.Microsecond)), nil
+}
+
+// String returns the event in plain format, as received from FreeSWITCH, with the headers sorted
+func (ev *Event) String() string {
+	hdrs := make([]string, 0, len(ev.Headers))
+	for hdr := range ev.Headers {
+		if !strings.EqualFold(hdr, "Content-Length") { // computed out of the body
+			hdrs = append(hdrs, hdr)
+		}
+	}
+	sort.Strings(hdrs)
+	var sb strings.Builder
+	for _, hdr := range hdrs {
+		sb.WriteString(hdr + ": " + URLEncode(ev.Headers[hdr]) + "\n")
+	}
+	if len(ev.Body) != 0 {
+		sb.WriteString("Content-Length: " + strconv.Itoa(len(ev.Body)) + "\n\n" + ev.Body)
+	}
+	return sb.String()
+}
@@ -0,0 +1,108 @@
+/*
+event_test.go is released under the MIT License <http://www.opensource.org/licenses/mit-license.php
+Copyright (C) ITsysCOM. All Rights Reserved.
+
+Provides FreeSWITCH socket communication.
+
+*/
+
+package fsock
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventNewEvent(t *testing.T) {
+	ev := NewEvent("Event-Name: CUSTOM\nEvent-Subclass: sofia%3A%3Aregister\nContent-Length: 5\n\nhello")
+	expected := &Event{
+		Name: "CUSTOM sofia::register",
+		Headers: map[string]string{
+			"Event-Name":     "CUSTOM",
+			"Event-Subclass": "sofia::register",
+			"Content-Length": "5",
+		},
+		Body: "hello",
+	}
+	if !reflect.DeepEqual(ev, expected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, ev)
+	}
+	if val := ev.Get("Event-Subclass"); val != "sofia::register" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "sofia::register", val)
+	}
+	if val := ev.Get("Missing"); val != "" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "", val)
+	}
+}
+
+func TestEventString(t *testing.T) {
+	event := "Event-Name: CUSTOM\nEvent-Subclass: sofia%3A%3Aregister\nCaller-Caller-ID-Name: Dan%20Ionescu\nContent-Length: 5\n\nhello"
+	ev := NewEvent(event)
+	expected := "Caller-Caller-ID-Name: Dan%20Ionescu\nEvent-Name: CUSTOM\nEvent-Subclass: sofia%3A%3Aregister\nContent-Length: 5\n\nhello"
+	if evStr := ev.String(); evStr != expected {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, evStr)
+	}
+	if rcv := NewEvent(ev.String()); !reflect.DeepEqual(ev, rcv) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ev, rcv)
+	}
+	ev.Body = ""
+	if evStr := ev.String(); evStr != "Caller-Caller-ID-Name: Dan%20Ionescu\nEvent-Name: CUSTOM\nEvent-Subclass: sofia%3A%3Aregister\n" {
+		t.Errorf("unexpected event without body: %q", evStr)
+	}
+}
+
+func TestEventGetTyped(t *testing.T) {
+	ev := NewEvent("Event-Name: CHANNEL_HANGUP_COMPLETE\nChannel-Read-Codec-Rate: 8000\nvariable_rtp_audio_in_mos: 4.42\n" +
+		"variable_sip_from_user: true\nvariable_is_outbound: 0\nvariable_ep_codec: enabled\nvariable_billsec: 12\n" +
+		"variable_billusec: 12500000\nvariable_wait_time: 1.5s\nvariable_bad: abc\n")
+	if i, err := ev.GetInt("Channel-Read-Codec-Rate"); err != nil || i != 8000 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", 8000, i, err)
+	}
+	if f, err := ev.GetFloat("variable_rtp_audio_in_mos"); err != nil || f != 4.42 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", 4.42, f, err)
+	}
+	for hdr, exp := range map[string]bool{"variable_sip_from_user": true, "variable_is_outbound": false, "variable_ep_codec": true} {
+		if b, err := ev.GetBool(hdr); err != nil || b != exp {
+			t.Errorf("%s\nExpected: <%+v>, \nReceived: <%+v> %v", hdr, exp, b, err)
+		}
+	}
+	if d, err := ev.GetDuration("variable_billsec", time.Second); err != nil || d != 12*time.Second {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", 12*time.Second, d, err)
+	}
+	if d, err := ev.GetDuration("variable_billusec", time.Microsecond); err != nil || d != 12500*time.Millisecond {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", 12500*time.Millisecond, d, err)
+	}
+	if d, err := ev.GetDuration("variable_wait_time", time.Second); err != nil || d != 1500*time.Millisecond {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", 1500*time.Millisecond, d, err)
+	}
+
+	if _, err := ev.GetInt("variable_bad"); err == nil || err.Error() != `Cannot parse header <variable_bad> as integer: strconv.ParseInt: parsing "abc": invalid syntax` {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ev.GetFloat("variable_bad"); err == nil {
+		t.Error("expected error for malformed float")
+	}
+	if _, err := ev.GetBool("variable_bad"); err == nil || err.Error() != "Cannot parse header <variable_bad> as boolean: <abc>" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := ev.GetDuration("variable_bad", time.Second); err == nil {
+		t.Error("expected error for malformed duration")
+	}
+	if _, err := ev.GetInt("variable_missing"); err == nil || err.Error() != "Header <variable_missing> missing" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEventTimestamp(t *testing.T) {
+	ev := NewEvent("Event-Name: HEARTBEAT\nEvent-Date-Local: 2023-03-14 10:20:30\nEvent-Date-Timestamp: 1678789230123456\n")
+	expected := time.Date(2023, 3, 14, 10, 20, 30, 123456000, time.UTC)
+	if tm, err := ev.Timestamp(); err != nil {
+		t.Fatal(err)
+	} else if !tm.Equal(expected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, tm.UTC())
+	}
+	if _, err := NewEvent("Event-Name: HEARTBEAT\n").Timestamp(); err == nil || err.Error() != "Header <Event-Date-Timestamp> missing" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
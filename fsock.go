@@ -11,20 +11,45 @@ package fsock
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	DelayFunc func() func() int
 
+	ApiRetryDelay      = 100 * time.Millisecond    // Base of the Fibonacci delays between API command retries
+	TransientApiErrors = []string{"-ERR no reply"} // Default API errors considered transient and retried
+
+	ConnectTimeout = 30 * time.Second // Limits dialing and the handshake when connecting without a context, 0 for no limit
+
+	GreetingTimeout = 5 * time.Second // Limits each read of the auth challenge, 0 to wait for it as long as the connect allows
+	GreetingRetries = 2               // Number of times the auth challenge read is retried after timing out
+
+	UUIDEventsBuffer = 64   // Size of the channels returned by SubscribeUUID
+	EventsChanBuffer = 1024 // Default size of the channel returned by EventsChan
+
 	ErrConnectionPoolTimeout = errors.New("ConnectionPool timeout")
+	ErrAuthRejected          = errors.New("Authentication rejected") // FreeSWITCH refused the password
+	ErrNoSuchChannel         = errors.New("No such channel")
+	ErrAccessDenied          = errors.New("Access denied by FreeSWITCH ACL")
+	ErrBgJobLost             = errors.New("Connection lost before the background job finished")
+	ErrCircuitOpen           = errors.New("ConnectionPool circuit breaker open")
+	ErrTooManyCommands       = errors.New("Too many commands waiting on the socket")
+	ErrConnectionClosed      = errors.New("Connection closed by FreeSWITCH") // io.EOF on the socket, expected on FreeSWITCH shutdown
+	ErrClosed                = errors.New("FSock closed, Connect or Reconnect to use it again")
 )
 
 func init() {
@@ -35,103 +60,672 @@ func init() {
 func NewFSock(fsaddr, fspaswd string, reconnects int,
 	eventHandlers map[string][]func(string, int),
 	eventFilters map[string][]string,
-	l logger, connIdx int, bgapiSubsc bool) (fsock *FSock, err error) {
-	if l == nil {
-		l = nopLogger{}
+	l Logger, connIdx int, bgapiSubsc bool) (fsock *FSock, err error) {
+	return NewFSockFromConfig(Config{
+		Address:        fsaddr,
+		Password:       fspaswd,
+		Reconnects:     reconnects,
+		EventHandlers:  eventHandlers,
+		EventFilters:   eventFilters,
+		Logger:         l,
+		ConnIdx:        connIdx,
+		BgapiSubscribe: bgapiSubsc,
+	})
+}
+
+// NewFSockLazy returns the FSock without connecting to FS
+// The connection is done on first command, on ReadEvents or on explicit Connect
+// The first connection is attempted even with 0 reconnects, these applying once it is lost
+func NewFSockLazy(fsaddr, fspaswd string, reconnects int,
+	eventHandlers map[string][]func(string, int),
+	eventFilters map[string][]string,
+	l Logger, connIdx int, bgapiSubsc bool) (fsock *FSock, err error) {
+	return NewFSockFromConfig(Config{
+		Address:        fsaddr,
+		Password:       fspaswd,
+		Reconnects:     reconnects,
+		EventHandlers:  eventHandlers,
+		EventFilters:   eventFilters,
+		Logger:         l,
+		ConnIdx:        connIdx,
+		BgapiSubscribe: bgapiSubsc,
+		Lazy:           true,
+	})
+}
+
+// TestConnection checks that FreeSWITCH accepts the connection and the password, disconnecting right after the auth
+// Meant for the readiness probes at startup, no events are subscribed
+func TestConnection(ctx context.Context, addr, password string, tlsCfg *tls.Config) (err error) {
+	var fs *FSock
+	if fs, err = NewFSockFromConfig(Config{Address: addr, Password: password, TLSConfig: tlsCfg, Lazy: true}); err != nil {
+		return
 	}
-	fsock = &FSock{
-		fsMutex:         new(sync.RWMutex),
-		connIdx:         connIdx,
-		fsaddress:       fsaddr,
-		fspaswd:         fspaswd,
-		eventHandlers:   eventHandlers,
-		eventFilters:    eventFilters,
-		backgroundChans: make(map[string]chan string),
-		cmdChan:         make(chan string),
-		reconnects:      reconnects,
-		delayFunc:       DelayFunc(),
-		logger:          l,
-		bgapiSubsc:      bgapiSubsc,
-	}
-	if err = fsock.Connect(); err != nil {
-		return nil, err
+	var conn net.Conn
+	if conn, err = fs.dial(ctx); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return
+	}
+	defer conn.Close()
+	fs.fsMutex.Lock()
+	fs.conn = conn
+	fs.buffer = bufio.NewReaderSize(conn, 8192)
+	fs.fsMutex.Unlock()
+	stopWatching := watchCtx(ctx, conn)
+	defer stopWatching()
+	if err = fs.authenticate(ctx); err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
 	return
 }
 
+const maxBodyBufSize = 64 << 10 // Bigger bodies are read in their own buffer so the memory is not kept
+
 // FSock reperesents the connection to FreeSWITCH Socket
 type FSock struct {
+	lastActivity    int64  // UnixNano of the last frame read, accessed atomically so keep it first for 64-bit alignment
+	connectedSince  int64  // UnixNano of the last successful connect, accessed atomically
+	cmdTimeout      int64  // time.Duration limiting the replies of the commands sent without a context, accessed atomically
+	writeTimeout    int64  // time.Duration limiting each write on the socket, accessed atomically
+	queueDropped    uint64 // Events dropped by the full event queue, accessed atomically
 	conn            net.Conn
 	fsMutex         *sync.RWMutex
 	connIdx         int // Indetifier for the component using this instance of FSock, optional
 	buffer          *bufio.Reader
+	fsnetwork       string       // tcp(default), tls or unix
+	localAddr       *net.TCPAddr // Local address the connections originate from, any when nil
+	tlsConfig       *tls.Config  // Config of the tls connections, the host verified when nil
+	linger          *int         // SO_LINGER seconds applied to the tcp connections, system default when nil
 	fsaddress       string
 	fspaswd         string
+	handlersMux     sync.RWMutex                   // Protects eventHandlers, eventFilters, events, replayEvents, uuidSubs and syncDispatch
 	eventHandlers   map[string][]func(string, int) // eventStr, connId
+	replaySize      int                            // Number of recent events kept for replay, 0 to disable
+	replayEvents    []*replayEvent                 // Recent events, oldest first
 	eventFilters    map[string][]string
+	events          map[string]bool // Events subscribed with AddEvents or SetEvents, besides the handled ones
+	tempEvents      map[string]int  // Events subscribed while OriginateAndWait runs, by number of calls
+	myEventsUUID    string          // Channel whose events only are received, with myevents
+	allowedEvents   map[string]bool // Event names dispatched to handlers, all when empty
+	eventsChan      chan *Event     // Receives the dispatched events once EventsChan is called
+	eventsChanSize  int
+	eventsChanDrop  bool                                // Drop the events when eventsChan is full instead of blocking
+	uuidSubs        map[string]map[chan *Event]struct{} // Channels receiving the events of one Unique-ID
+	syncDispatch    bool                                // Run the handlers on one dispatching goroutine, in order
+	evQueueSize     int                                 // Events queued between the reading and the dispatching, 0 to dispatch while reading
+	evQueuePolicy   EventQueuePolicy                    // Applied when the event queue is full
+	eventTransform  func(*Event) *Event                 // Applied to the events before dispatching them, nil drops the event
+	charsetDecoder  func(string) string                 // Converts the charset of the event values to UTF-8, nil for passthrough
+	charsetHeaders  []string                            // Headers decoded by charsetDecoder, all and the body if empty
+	otherFrames     func(string, string, string)        // Receives the frames of unknown Content-Type, contentType, header, body
+	onLog           func(level, line string)            // Receives the log/data frames, see OnLog
+	onDiscNotice    func()                              // Called on text/disconnect-notice, before disconnecting
+	dispatchPaused  bool                                // Events held or dropped instead of dispatched, see PauseDispatch
+	pauseHold       int                                 // Events held while the dispatch is paused
+	heldEvents      []string                            // Events read while paused, dispatched on ResumeDispatch
 	backgroundChans map[string]chan string
-	cmdChan         chan string
+	cmdQueue        cmdQueue       // Serializes writing a command with queueing the channel waiting for its reply
+	rplyMux         sync.Mutex     // Protects rplyChans
+	rplyChans       []pendingReply // Commands waiting for their replies, in the order the commands were sent
+	cmdSlots        chan struct{}  // Limits the commands in flight, nil for no limit, protected by rplyMux
+	connectMux      sync.Mutex     // Serializes the connects of Connect, Reconnect and ReconnectIfNeeded
 	reconnects      int
-	delayFunc       func() int
-	stopReadEvents  chan struct{} //Keep a reference towards forkedReadEvents so we can stop them whenever necessary
+	delayFunc       func() int          // Seconds between the reconnect attempts, protected by fsMutex
+	sleep           func(time.Duration) // Waits between the reconnect attempts, time.Sleep if nil, protected by fsMutex
+	maxDelay        time.Duration       // Caps the delays between the reconnect attempts, 0 for no cap, protected by fsMutex
+	stopReadEvents  chan struct{}       //Keep a reference towards forkedReadEvents so we can stop them whenever necessary
 	errReadEvents   chan error
-	logger          logger
+	readEventsWg    sync.WaitGroup // Tracks the goroutine reading events so we do not connect while it still runs
+	handlersWg      sync.WaitGroup // Tracks the running event handlers so CloseWait can wait for them
+	closed          chan struct{}  // Closed by Close so ReadEvents returns
+	logger          Logger
+	seqMux          sync.Mutex
+	seqTrack        bool                            // Detect the gaps in Event-Sequence
+	onSeqGap        func(expected, received uint64) // Called on each gap detected
+	lastSeq         uint64                          // Event-Sequence of the last event, 0 after connect
+	droppedEvents   uint64                          // Events missed according to the gaps in Event-Sequence
+	labelsMux       sync.RWMutex
+	labels          map[string]string // Added to Stats and to the log lines
+	logWriter       Logger            // Receives the lines of logger, replaced with SetLogger, protected by labelsMux
+	trace           int32             // 1 to log the raw socket I/O, accessed atomically
+	msgURLEncode    int32             // 1 to URL-encode the sendmsg header values, accessed atomically
+	eventLock       int32             // 1 to send the execute commands with event-lock by default, accessed atomically
+	validateEvents  int32             // 1 to warn about the subscriptions to unknown event names, accessed atomically
+	reconnecting    int32             // Number of reconnect loops running, accessed atomically
+	reconnectTry    int32             // Current attempt of the reconnect loop, accessed atomically
+	lazyConnect     int32             // 1 until the first connect of the lazy sockets, attempted even with 0 reconnects, accessed atomically
+	bodyBuf         []byte            // Buffer reused by readBody
+	framesMux       sync.Mutex
+	framesSize      int        // Number of frames kept in history, 0 to disable
+	frames          []RawFrame // Last frames read, oldest first
+	deadSize        int        // Number of undispatchable events kept, 0 to disable, protected by framesMux
+	deadEvents      []*Event   // Last events without handlers, oldest first
 	bgapiSubsc      bool
+	onDisconnect    func(int)                    // called with connIdx when the connection is lost while reading events
+	onReconnectTry  func(int, string, error)     // called with the attempt, the address and its error after each reconnect attempt
+	maxBodySize     int                          // events with bigger bodies are passed to bodyStreamer
+	bodyStreamer    func(string, io.Reader, int) // headers, body, connIdx
+	apiRetries      int                          // Number of retries for API commands failing with transient errors
+	transientErrs   []string                     // Prefixes of the API errors considered transient
+	apiCacheTTL     time.Duration
+	apiCacheCmds    map[string]bool          // API commands allowed to be cached
+	apiCache        map[string]*apiCacheItem // cached API replies, indexed on command
+}
+
+// SetBodyStreamer passes the events with bodies longer than maxBodySize to the streamer instead of the event handlers
+// The body reader is only valid until the streamer returns, the BACKGROUND_JOB events are never streamed
+func (fs *FSock) SetBodyStreamer(maxBodySize int, streamer func(headers string, body io.Reader, connIdx int)) {
+	fs.fsMutex.Lock()
+	fs.maxBodySize = maxBodySize
+	fs.bodyStreamer = streamer
+	fs.fsMutex.Unlock()
+}
+
+// SetApiRetries retries the API commands failing with transient errors
+// The transient errors are identified by prefix, TransientApiErrors used when none given
+func (fs *FSock) SetApiRetries(retries int, transientErrs ...string) {
+	if len(transientErrs) == 0 {
+		transientErrs = TransientApiErrors
+	}
+	fs.fsMutex.Lock()
+	fs.apiRetries = retries
+	fs.transientErrs = transientErrs
+	fs.fsMutex.Unlock()
+}
+
+// isTransientApiErr checks if the API command should be retried for this error
+func (fs *FSock) isTransientApiErr(err error) bool {
+	fs.fsMutex.RLock()
+	defer fs.fsMutex.RUnlock()
+	for _, transientErr := range fs.transientErrs {
+		if strings.HasPrefix(err.Error(), transientErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiCacheItem is an API reply cached until expiry
+type apiCacheItem struct {
+	rply    string
+	expires time.Time
+}
+
+// SetApiCache caches for ttl the replies of the listed API commands, a zero ttl disables the cache
+func (fs *FSock) SetApiCache(ttl time.Duration, cmds ...string) {
+	fs.fsMutex.Lock()
+	fs.apiCacheTTL = ttl
+	fs.apiCacheCmds = make(map[string]bool)
+	for _, cmd := range cmds {
+		fs.apiCacheCmds[cmd] = true
+	}
+	fs.apiCache = make(map[string]*apiCacheItem)
+	fs.fsMutex.Unlock()
+}
+
+// SetPassword changes the password used on the next connect, call Reconnect to apply it right away
+func (fs *FSock) SetPassword(fspaswd string) {
+	fs.fsMutex.Lock()
+	fs.fspaswd = fspaswd
+	fs.fsMutex.Unlock()
+}
+
+// SetTrace enables logging at debug level of all the data written to and read from the socket
+func (fs *FSock) SetTrace(enabled bool) {
+	var trace int32
+	if enabled {
+		trace = 1
+	}
+	atomic.StoreInt32(&fs.trace, trace)
+}
+
+func (fs *FSock) tracing() bool {
+	return atomic.LoadInt32(&fs.trace) == 1
+}
+
+// SetCmdTimeout limits the wait for the replies of the commands sent without a context, 0 waits forever
+func (fs *FSock) SetCmdTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&fs.cmdTimeout, int64(timeout))
+}
+
+// SetMaxPendingCmds limits the commands sent and waiting for their replies at once, 0 for no limit
+// The commands over the limit fail fast with ErrTooManyCommands instead of queueing
+func (fs *FSock) SetMaxPendingCmds(maxCmds int) {
+	fs.rplyMux.Lock()
+	fs.cmdSlots = nil
+	if maxCmds > 0 {
+		fs.cmdSlots = make(chan struct{}, maxCmds)
+	}
+	fs.rplyMux.Unlock()
+}
+
+// SetMaxInFlightCmds limits the commands written and waiting for their replies, 0 for no limit
+// The next commands wait on our side, in the order of their priority, instead of queueing at FreeSWITCH behind the written ones
+func (fs *FSock) SetMaxInFlightCmds(maxCmds int) {
+	fs.cmdQueue.setMaxInFlight(maxCmds)
+}
+
+// SetWriteTimeout limits the time a command write can block, 0 for no limit
+// A timed out write disconnects so the next command reconnects
+func (fs *FSock) SetWriteTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&fs.writeTimeout, int64(timeout))
+}
+
+// SetLocalAddr binds the next connections to the local address, given as IP or IP:port
+// An empty address lets the system choose it
+func (fs *FSock) SetLocalAddr(localAddr string) (err error) {
+	var tcpAddr *net.TCPAddr
+	if localAddr != "" {
+		if _, _, errSplit := net.SplitHostPort(localAddr); errSplit != nil {
+			localAddr = net.JoinHostPort(localAddr, "0")
+		}
+		if tcpAddr, err = net.ResolveTCPAddr("tcp", localAddr); err != nil {
+			return fmt.Errorf("Invalid local address <%s>: %s", localAddr, err)
+		}
+	}
+	fs.fsMutex.Lock()
+	fs.localAddr = tcpAddr
+	fs.fsMutex.Unlock()
+	return
+}
+
+// SetLinger sets SO_LINGER on the next tcp connections, see net.TCPConn.SetLinger for the meaning of sec
+// The tls and unix connections keep the system default
+func (fs *FSock) SetLinger(sec int) {
+	fs.fsMutex.Lock()
+	fs.linger = &sec
+	fs.fsMutex.Unlock()
+}
+
+// applyLinger sets the configured SO_LINGER on the connection, if it supports it
+func (fs *FSock) applyLinger(conn net.Conn) {
+	fs.fsMutex.RLock()
+	linger := fs.linger
+	fs.fsMutex.RUnlock()
+	if linger == nil {
+		return
+	}
+	lConn, canLinger := conn.(interface{ SetLinger(int) error })
+	if !canLinger {
+		return
+	}
+	if err := lConn.SetLinger(*linger); err != nil {
+		fs.logger.Warning(fmt.Sprintf("<FSock> Cannot set linger on the connection: %s", err.Error()))
+	}
+}
+
+// SetOnDisconnect sets the function called when the connection is lost while reading events
+func (fs *FSock) SetOnDisconnect(f func(connIdx int)) {
+	fs.fsMutex.Lock()
+	fs.onDisconnect = f
+	fs.fsMutex.Unlock()
+}
+
+// SetOnReconnectAttempt sets the function called after each attempt of ReconnectIfNeeded, err being nil on success
+func (fs *FSock) SetOnReconnectAttempt(f func(attempt int, addr string, err error)) {
+	fs.fsMutex.Lock()
+	fs.onReconnectTry = f
+	fs.fsMutex.Unlock()
 }
 
-// Connect or reconnect
+// Connect or reconnect, limiting the dial and the handshake to ConnectTimeout
 func (fs *FSock) Connect() error {
+	ctx, cancel := connectTimeoutCtx()
+	defer cancel()
+	return fs.ConnectCtx(ctx)
+}
+
+// ConnectCtx connects to FreeSWITCH, abandoning the dial and the handshake once the context is done
+func (fs *FSock) ConnectCtx(ctx context.Context) error {
+	fs.connectMux.Lock()
+	defer fs.connectMux.Unlock()
+	fs.stopReadingEvents()
+	// Reinit readEvents channels so we avoid concurrency issues between goroutines
+	fs.fsMutex.Lock()
+	fs.errReadEvents = make(chan error)
+	fs.reopen()
+	fs.fsMutex.Unlock()
+	return fs.connectCtx(ctx)
+}
+
+// Reconnect drops the current connection and connects again, restarting the reconnect delay sequence
+// Useful when FreeSWITCH is known to have restarted
+func (fs *FSock) Reconnect() error {
+	fs.resetDelay()
+	return fs.Connect()
+}
+
+// SetSleepFunc replaces time.Sleep between the reconnect attempts, like to test the delays without waiting
+// nil restores time.Sleep
+func (fs *FSock) SetSleepFunc(sleep func(time.Duration)) {
+	fs.fsMutex.Lock()
+	fs.sleep = sleep
+	fs.fsMutex.Unlock()
+}
+
+// SetMaxReconnectDelay caps the Fibonacci delays between the reconnect attempts, 0 for no cap
+func (fs *FSock) SetMaxReconnectDelay(maxDelay time.Duration) {
+	fs.fsMutex.Lock()
+	fs.maxDelay = maxDelay
+	fs.fsMutex.Unlock()
+}
+
+// nextDelay returns the wait before the next reconnect attempt, capped by SetMaxReconnectDelay
+func (fs *FSock) nextDelay() time.Duration {
+	fs.fsMutex.Lock()
+	defer fs.fsMutex.Unlock()
+	return cappedDelay(fs.delayFunc, fs.maxDelay)
+}
+
+// resetDelay restarts the sequence of the reconnect delays
+func (fs *FSock) resetDelay() {
+	fs.fsMutex.Lock()
+	fs.delayFunc = DelayFunc()
+	fs.fsMutex.Unlock()
+}
+
+// Close stops reading the events and disconnects, making ReadEvents return
+// The commands fail afterwards with ErrClosed instead of reconnecting, until Connect or Reconnect
+func (fs *FSock) Close() {
+	fs.close()
+	fs.readEventsWg.Wait()
+}
+
+// CloseWait closes and waits up to timeout for the reading and the running event handlers to finish
+func (fs *FSock) CloseWait(timeout time.Duration) error {
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+	fs.close()
+	handlersDone := make(chan struct{})
+	go func() { // the reading can be held by a slow synchronous handler
+		fs.readEventsWg.Wait()
+		fs.handlersWg.Wait()
+		close(handlersDone)
+	}()
+	select {
+	case <-handlersDone:
+		return nil
+	case <-tm.C:
+		return errors.New("Timeout waiting for the event handlers to finish")
+	}
+}
+
+// close marks the FSock closed and disconnects, requesting the reading to stop without waiting for it
+func (fs *FSock) close() {
+	fs.fsMutex.Lock()
+	if fs.closed == nil {
+		fs.closed = make(chan struct{})
+	}
+	select {
+	case <-fs.closed: // already closed
+	default:
+		close(fs.closed)
+	}
+	fs.fsMutex.Unlock()
+	fs.requestStopReading()
+}
+
+// isClosed checks if Close was called since the last Connect or Reconnect
+func (fs *FSock) isClosed() bool {
+	fs.fsMutex.RLock()
+	defer fs.fsMutex.RUnlock()
+	return fs.closedLocked()
+}
+
+// closedLocked is isClosed with fsMutex already locked
+func (fs *FSock) closedLocked() bool {
+	select {
+	case <-fs.closed:
+		return true
+	default: // also for the nil channel of the sockets never closed
+		return false
+	}
+}
+
+// reopen recreates the closed channel after a Close, fsMutex needs to be locked
+func (fs *FSock) reopen() {
+	select {
+	case <-fs.closed:
+		fs.closed = make(chan struct{})
+	default:
+	}
+}
+
+// stopReadingEvents disconnects and waits for the events reading on the old connection to stop
+func (fs *FSock) stopReadingEvents() {
+	fs.requestStopReading()
+	fs.readEventsWg.Wait()
+}
+
+// requestStopReading disconnects and requests the events reading on the old connection to stop
+func (fs *FSock) requestStopReading() {
+	fs.fsMutex.Lock()
 	if fs.stopReadEvents != nil {
 		close(fs.stopReadEvents) // we have read events already processing, request stop
 	}
-	// Reinit readEvents channels so we avoid concurrency issues between goroutines
 	fs.stopReadEvents = make(chan struct{})
-	fs.errReadEvents = make(chan error)
-	return fs.connect()
+	fs.fsMutex.Unlock()
+	fs.Disconnect()
+}
+
+// connectTimeoutCtx returns the context limiting a connect to ConnectTimeout
+func connectTimeoutCtx() (context.Context, context.CancelFunc) {
+	if ConnectTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), ConnectTimeout)
 }
 
-func (fs *FSock) connect() (err error) {
+func (fs *FSock) connect() error {
+	ctx, cancel := connectTimeoutCtx()
+	defer cancel()
+	return fs.connectCtx(ctx)
+}
+
+func (fs *FSock) connectCtx(ctx context.Context) (err error) {
 	if fs.Connected() {
 		fs.Disconnect()
 	}
 
 	var conn net.Conn
-	if conn, err = net.Dial("tcp", fs.fsaddress); err != nil {
+	if conn, err = fs.dial(ctx); err != nil {
 		fs.logger.Err(fmt.Sprintf("<FSock> Attempt to connect to FreeSWITCH, received: %s", err.Error()))
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		return
 	}
+	fs.applyLinger(conn)
 	fs.fsMutex.Lock()
 	fs.conn = conn
+	fs.buffer = bufio.NewReaderSize(conn, 8192) // fresh buffer, nothing left from the previous connection
 	fs.fsMutex.Unlock()
+	fs.dropPendingReplies()
 	fs.logger.Info("<FSock> Successfully connected to FreeSWITCH!")
-	// Connected, init buffer, auth and subscribe to desired events and filters
-	fs.fsMutex.RLock()
-	fs.buffer = bufio.NewReaderSize(fs.conn, 8192) // reinit buffer
-	fs.fsMutex.RUnlock()
+	// Connected, auth and subscribe to desired events and filters
 
-	var authChg string
-	if authChg, err = fs.readHeaders(); err != nil {
-		return fmt.Errorf("Received error<%s> when receiving the auth challenge", err)
+	stopWatching := watchCtx(ctx, conn)
+	err = fs.handshake(ctx)
+	stopWatching()
+	if err != nil {
+		if ctx.Err() != nil {
+			fs.Disconnect()
+			return ctx.Err()
+		}
+		return
 	}
-	if !strings.Contains(authChg, "auth/request") {
-		return errors.New("No auth challenge received")
+	atomic.StoreInt64(&fs.connectedSince, time.Now().UnixNano())
+	atomic.StoreInt32(&fs.lazyConnect, 0)
+	fs.seqMux.Lock()
+	fs.lastSeq = 0 // the events in between connections are not counted as dropped
+	fs.seqMux.Unlock()
+	fs.fsMutex.Lock()
+	if fs.closedLocked() { // closed while connecting, Close is already waiting for the reader
+		fs.fsMutex.Unlock()
+		fs.Disconnect()
+		return ErrClosed
 	}
-	if err = fs.auth(); err != nil { // Auth did not succeed
+	stopReadEvents, errReadEvents := fs.stopReadEvents, fs.errReadEvents
+	fs.readEventsWg.Add(1) // under fsMutex so it is ordered with the Wait of Close
+	fs.fsMutex.Unlock()
+	go func() { // Fork read events in it's own goroutine
+		fs.readEvents(stopReadEvents, errReadEvents)
+		fs.readEventsWg.Done()
+	}()
+	return
+}
+
+// handshake authenticates and applies the filters and the event subscriptions
+func (fs *FSock) handshake(ctx context.Context) (err error) {
+	if err = fs.authenticate(ctx); err != nil {
 		return
 	}
 
-	if err = fs.filterEvents(fs.eventFilters, fs.bgapiSubsc); err != nil {
+	fs.handlersMux.RLock()
+	myEventsUUID := fs.myEventsUUID
+	eventFilters := make(map[string][]string)
+	for hdr, vals := range fs.eventFilters {
+		eventFilters[hdr] = append([]string{}, vals...)
+	}
+	fs.handlersMux.RUnlock()
+	if myEventsUUID != "" { // before the filters refining it
+		if err = fs.myEvents(myEventsUUID); err != nil {
+			return
+		}
+	}
+	if err = fs.filterEvents(eventFilters, fs.bgapiSubsc); err != nil {
 		return
 	}
 
-	// Subscribe to events handled by event handlers
-	if err = fs.eventsPlain(getMapKeys(fs.eventHandlers), fs.bgapiSubsc); err != nil {
+	// Subscribe to events handled by event handlers and to the ones added explicitly
+	return fs.eventsPlain(fs.subscribedEvents(), fs.bgapiSubsc)
+}
+
+// authenticate waits for the auth challenge and replies to it with the password
+func (fs *FSock) authenticate(ctx context.Context) (err error) {
+	var authChg string
+	if authChg, err = fs.readGreeting(ctx); err != nil {
+		return fmt.Errorf("Received error<%s> when receiving the auth challenge", err)
+	}
+	switch headerVal(authChg, "Content-Type") {
+	case "auth/request":
+	case "text/rude-rejection": // FreeSWITCH ACL refused our address
+		fs.Disconnect()
+		return ErrAccessDenied
+	default:
+		return errors.New("No auth challenge received")
+	}
+	return fs.auth()
+}
+
+// readGreeting reads the auth challenge, retrying the reads timing out after GreetingTimeout up to GreetingRetries times
+// The deadline of ctx is restored afterwards so watchCtx still limits the rest of the handshake
+func (fs *FSock) readGreeting(ctx context.Context) (greeting string, err error) {
+	if GreetingTimeout <= 0 {
+		for greeting == "" && err == nil { // skip the blank lines in front of it
+			greeting, err = fs.readHeaders()
+		}
 		return
 	}
-	go fs.readEvents() // Fork read events in it's own goroutine
+	fs.fsMutex.RLock()
+	conn := fs.conn
+	fs.fsMutex.RUnlock()
+	ctxDeadline, _ := ctx.Deadline()
+	defer func() {
+		conn.SetReadDeadline(ctxDeadline)
+		if ctx.Err() != nil { // done meanwhile, the deadline set by watchCtx was overwritten
+			conn.SetReadDeadline(time.Now())
+		}
+	}()
+	var hdrs, line []byte
+	for retry := 0; ; retry++ {
+		deadline := time.Now().Add(GreetingTimeout)
+		if !ctxDeadline.IsZero() && ctxDeadline.Before(deadline) {
+			deadline = ctxDeadline
+		}
+		conn.SetReadDeadline(deadline)
+		if err = ctx.Err(); err != nil {
+			break
+		}
+		for {
+			var part []byte
+			if part, err = fs.buffer.ReadBytes('\n'); err != nil {
+				line = append(line, part...) // keep the partial line for the retry
+				break
+			}
+			line = append(line, part...)
+			if len(bytes.TrimSpace(line)) == 0 && len(hdrs) == 0 { // blank line in front of the greeting
+				line = line[:0]
+				continue
+			}
+			if len(bytes.TrimSpace(line)) == 0 { // empty line delimiting the headers
+				if fs.tracing() {
+					fs.logger.Debug(fmt.Sprintf("<FSock> Received headers: <%s>", hdrs))
+				}
+				return string(hdrs), nil
+			}
+			hdrs = append(append(hdrs, bytes.TrimRight(line, "\r\n")...), '\n')
+			line = line[:0]
+		}
+		if netErr, isNetErr := err.(net.Error); !isNetErr || !netErr.Timeout() ||
+			retry == GreetingRetries || ctx.Err() != nil {
+			break
+		}
+		fs.logger.Warning(fmt.Sprintf("<FSock> Timeout reading the auth challenge, retry %d of %d", retry+1, GreetingRetries))
+	}
+	fs.logger.Err(fmt.Sprintf("<FSock> Error reading headers: <%s>", err.Error()))
+	fs.Disconnect()
 	return
 }
 
+// watchCtx unblocks the reads and writes on conn once the context is done
+// The returned function stops the watching and clears the deadline set on conn
+func watchCtx(ctx context.Context, conn net.Conn) (stop func()) {
+	stopWatch := make(chan struct{})
+	watchDone := make(chan struct{})
+	go func() {
+		defer close(watchDone)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stopWatch:
+		}
+	}()
+	return func() {
+		close(stopWatch)
+		<-watchDone
+		conn.SetDeadline(time.Time{})
+	}
+}
+
+// dial opens the connection to FreeSWITCH over the configured network
+func (fs *FSock) dial(ctx context.Context) (net.Conn, error) {
+	dialer := new(net.Dialer)
+	fs.fsMutex.RLock()
+	if fs.localAddr != nil && fs.fsnetwork != "unix" {
+		dialer.LocalAddr = fs.localAddr
+	}
+	fs.fsMutex.RUnlock()
+	switch fs.fsnetwork {
+	case "tls":
+		host, _, _ := net.SplitHostPort(fs.fsaddress)
+		tlsConfig := new(tls.Config)
+		if fs.tlsConfig != nil {
+			tlsConfig = fs.tlsConfig.Clone()
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		tlsDialer := &tls.Dialer{NetDialer: dialer, Config: tlsConfig}
+		return tlsDialer.DialContext(ctx, "tcp", fs.fsaddress)
+	case "unix":
+		return dialer.DialContext(ctx, "unix", fs.fsaddress)
+	default:
+		return dialer.DialContext(ctx, "tcp", fs.fsaddress)
+	}
+}
+
 // Connected checks if socket connected. Can be extended with pings
 func (fs *FSock) Connected() (ok bool) {
 	fs.fsMutex.RLock()
@@ -140,6 +734,118 @@ func (fs *FSock) Connected() (ok bool) {
 	return
 }
 
+// ConnectedSince returns the time of the last successful connect, zero if never connected
+func (fs *FSock) ConnectedSince() time.Time {
+	connectedSince := atomic.LoadInt64(&fs.connectedSince)
+	if connectedSince == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, connectedSince)
+}
+
+// Uptime returns for how long the current connection is up, 0 if not connected
+func (fs *FSock) Uptime() time.Duration {
+	if !fs.Connected() {
+		return 0
+	}
+	return time.Since(fs.ConnectedSince())
+}
+
+// SetLabel tags the socket with the label, shown in Stats and in the log lines, an empty value removes it
+func (fs *FSock) SetLabel(key, value string) {
+	fs.labelsMux.Lock()
+	defer fs.labelsMux.Unlock()
+	if value == "" {
+		delete(fs.labels, key)
+		return
+	}
+	if fs.labels == nil {
+		fs.labels = make(map[string]string)
+	}
+	fs.labels[key] = value
+}
+
+// Labels returns a copy of the labels of the socket
+func (fs *FSock) Labels() (labels map[string]string) {
+	fs.labelsMux.RLock()
+	defer fs.labelsMux.RUnlock()
+	labels = make(map[string]string, len(fs.labels))
+	for key, value := range fs.labels {
+		labels[key] = value
+	}
+	return
+}
+
+// SetLogger replaces the logger receiving the log lines of the socket, nil disabling the logging
+func (fs *FSock) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	fs.labelsMux.Lock()
+	fs.logWriter = l
+	fs.labelsMux.Unlock()
+}
+
+// logOutput returns the logger set with SetLogger
+func (fs *FSock) logOutput() Logger {
+	fs.labelsMux.RLock()
+	defer fs.labelsMux.RUnlock()
+	return fs.logWriter
+}
+
+// labeled appends the labels, sorted by key, to the log message
+func (fs *FSock) labeled(msg string) string {
+	fs.labelsMux.RLock()
+	defer fs.labelsMux.RUnlock()
+	if len(fs.labels) == 0 {
+		return msg
+	}
+	keys := make([]string, 0, len(fs.labels))
+	for key := range fs.labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for i, key := range keys {
+		keys[i] = key + "=" + fs.labels[key]
+	}
+	return msg + " [" + strings.Join(keys, " ") + "]"
+}
+
+// Stats is a snapshot of the socket state, for metrics
+type Stats struct {
+	Address        string
+	Connected      bool
+	ConnectedSince time.Time
+	LastActivity   time.Time
+	PendingReplies int    // Commands waiting for their reply
+	PendingBgJobs  int    // Background jobs waiting for their BACKGROUND_JOB event
+	DroppedEvents  uint64 // Estimate out of the Event-Sequence gaps, when tracked
+	QueueDropped   uint64 // Events discarded by the full event queue, see SetEventQueue
+	Labels         map[string]string
+}
+
+// Stats returns the current state of the socket
+func (fs *FSock) Stats() (stats Stats) {
+	stats = Stats{
+		Connected:      fs.Connected(),
+		ConnectedSince: fs.ConnectedSince(),
+		LastActivity:   fs.LastActivity(),
+		Labels:         fs.Labels(),
+	}
+	fs.fsMutex.RLock()
+	stats.Address = fs.fsaddress
+	stats.PendingBgJobs = len(fs.backgroundChans)
+	fs.fsMutex.RUnlock()
+	fs.rplyMux.Lock()
+	stats.PendingReplies = len(fs.rplyChans)
+	fs.rplyMux.Unlock()
+	fs.seqMux.Lock()
+	stats.DroppedEvents = fs.droppedEvents
+	fs.seqMux.Unlock()
+	stats.QueueDropped = atomic.LoadUint64(&fs.queueDropped)
+	return
+}
+
 // Disconnect disconnects from socket
 func (fs *FSock) Disconnect() (err error) {
 	fs.fsMutex.Lock()
@@ -154,15 +860,42 @@ func (fs *FSock) Disconnect() (err error) {
 
 // ReconnectIfNeeded if not connected, attempt reconnect if allowed
 func (fs *FSock) ReconnectIfNeeded() (err error) {
+	if fs.isClosed() { // stays disconnected until an explicit Connect or Reconnect
+		return ErrClosed
+	}
 	if fs.Connected() { // No need to reconnect
 		return
 	}
-	for i := 0; fs.reconnects == -1 || i < fs.reconnects; i++ { // Maximum reconnects reached, -1 for infinite reconnects
-		if err = fs.connect(); err == nil && fs.Connected() {
-			fs.delayFunc = DelayFunc() // Reset the reconnect delay
-			break                      // No error or unrelated to connection
+	fs.connectMux.Lock()
+	defer fs.connectMux.Unlock()
+	if fs.Connected() { // connected meanwhile by a concurrent connect
+		return
+	}
+	// the reader of the lost connection could still be reading its buffered bytes, stop it before replacing the buffer
+	fs.stopReadingEvents()
+	atomic.AddInt32(&fs.reconnecting, 1)
+	defer atomic.AddInt32(&fs.reconnecting, -1)
+	attempts := fs.reconnects
+	if attempts == 0 && atomic.LoadInt32(&fs.lazyConnect) == 1 { // the lazy sockets still connect once
+		attempts = 1
+	}
+	for i := 0; attempts == -1 || i < attempts; i++ { // Maximum reconnects reached, -1 for infinite reconnects
+		atomic.StoreInt32(&fs.reconnectTry, int32(i+1))
+		err = fs.connect()
+		fs.fsMutex.RLock()
+		onReconnectTry, fsaddr := fs.onReconnectTry, fs.fsaddress
+		fs.fsMutex.RUnlock()
+		if onReconnectTry != nil {
+			onReconnectTry(i+1, fsaddr, err)
+		}
+		if err == nil && fs.Connected() {
+			fs.resetDelay()
+			break // No error or unrelated to connection
 		}
-		time.Sleep(time.Duration(fs.delayFunc()) * time.Second)
+		if fs.isClosed() { // closed meanwhile, stop retrying
+			return ErrClosed
+		}
+		fs.sleepFor(fs.nextDelay())
 	}
 	if err == nil && !fs.Connected() {
 		return errors.New("Not connected to FreeSWITCH")
@@ -170,296 +903,1976 @@ func (fs *FSock) ReconnectIfNeeded() (err error) {
 	return // nil or last error in the loop
 }
 
-func (fs *FSock) send(cmd string) (err error) {
-	fs.fsMutex.RLock()
-	defer fs.fsMutex.RUnlock()
-	if _, err = fs.conn.Write([]byte(cmd)); err != nil {
-		fs.logger.Err(fmt.Sprintf("<FSock> Cannot write command to socket <%s>", err.Error()))
+// Reconnecting returns true while ReconnectIfNeeded is retrying to connect
+func (fs *FSock) Reconnecting() bool {
+	return atomic.LoadInt32(&fs.reconnecting) != 0
+}
+
+// ReconnectAttempt returns the current attempt of the running reconnect, 0 if not reconnecting
+func (fs *FSock) ReconnectAttempt() int {
+	if !fs.Reconnecting() {
+		return 0
 	}
-	return
+	return int(atomic.LoadInt32(&fs.reconnectTry))
+}
+
+// sleepFor waits using the function set with SetSleepFunc if any
+func (fs *FSock) sleepFor(d time.Duration) {
+	fs.fsMutex.RLock()
+	sleep := fs.sleep
+	fs.fsMutex.RUnlock()
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	sleep(d)
+}
+
+// send is the single point writing to the socket, tracing and applying the write timeout
+// The command needs to be already framed, see terminated
+func (fs *FSock) send(cmd string) (err error) {
+	fs.fsMutex.RLock()
+	if fs.tracing() {
+		traced := cmd
+		if strings.HasPrefix(cmd, "auth ") {
+			traced = terminated("auth ****") // do not leak the password in logs
+		}
+		fs.logger.Debug(fmt.Sprintf("<FSock> Sent: <%s>", traced))
+	}
+	var deadline time.Time // zero clears the deadline left by a previous timeout
+	if writeTimeout := atomic.LoadInt64(&fs.writeTimeout); writeTimeout != 0 {
+		deadline = time.Now().Add(time.Duration(writeTimeout))
+	}
+	fs.conn.SetWriteDeadline(deadline)
+	_, err = fs.conn.Write([]byte(cmd))
+	fs.fsMutex.RUnlock()
+	if err != nil {
+		fs.logger.Err(fmt.Sprintf("<FSock> Cannot write command to socket <%s>", err.Error()))
+		if netErr, isNetErr := err.(net.Error); isNetErr && netErr.Timeout() {
+			fs.Disconnect() // the command may be partially written, reconnect to recover
+		}
+	}
+	return
 }
 
 // Auth to FS
 func (fs *FSock) auth() (err error) {
-	if err = fs.send("auth " + fs.fspaswd + "\n\n"); err != nil {
+	fs.fsMutex.RLock()
+	fspaswd := fs.fspaswd
+	fs.fsMutex.RUnlock()
+	if err = fs.send(terminated("auth " + fspaswd)); err != nil {
 		return
 	}
 	var rply string
 	if rply, err = fs.readHeaders(); err != nil {
 		return
 	}
-	if !strings.Contains(rply, "Reply-Text: +OK accepted") {
+	rplyTxt := headerVal(rply, "Reply-Text")
+	switch {
+	case strings.HasPrefix(rplyTxt, "+OK"):
+	case strings.HasPrefix(rplyTxt, "-ERR"):
+		return fmt.Errorf("%w: <%s>", ErrAuthRejected, rplyTxt)
+	default:
 		return fmt.Errorf("Unexpected auth reply received: <%s>", rply)
 	}
 	return
 }
 
 func (fs *FSock) sendCmd(cmd string) (rply string, err error) {
+	ctx, cancel := fs.cmdCtx()
+	defer cancel()
+	return fs.sendCmdCtx(ctx, cmd)
+}
+
+// cmdCtx returns the context limiting the commands sent without one to the default command timeout
+func (fs *FSock) cmdCtx() (context.Context, context.CancelFunc) {
+	cmdTimeout := atomic.LoadInt64(&fs.cmdTimeout)
+	if cmdTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(cmdTimeout))
+}
+
+// cmdTerminator is the empty line ending the commands written on the socket
+const cmdTerminator = "\n\n"
+
+// terminated ends the command, with or without its last new line, with cmdTerminator
+func terminated(cmd string) string {
+	return strings.TrimSuffix(cmd, "\n") + cmdTerminator
+}
+
+// sendCmdCtx sends the command and waits for its reply until the context is done
+func (fs *FSock) sendCmdCtx(ctx context.Context, cmd string) (rply string, err error) {
+	return fs.sendRawCmdCtx(ctx, terminated(cmd))
+}
+
+// sendRawCmdCtx sends the command as it should be written on the socket and waits for its reply
+func (fs *FSock) sendRawCmdCtx(ctx context.Context, cmd string) (rply string, err error) {
+	fs.rplyMux.Lock()
+	cmdSlots := fs.cmdSlots
+	fs.rplyMux.Unlock()
+	if cmdSlots != nil {
+		select {
+		case cmdSlots <- struct{}{}:
+			defer func() { <-cmdSlots }()
+		default:
+			return "", ErrTooManyCommands
+		}
+	}
 	if err = fs.ReconnectIfNeeded(); err != nil {
 		return
 	}
-	if err = fs.send(cmd + "\n"); err != nil {
+	var rplyChan chan string
+	if rplyChan, err = fs.sendWithReply(ctx, cmd); err != nil {
 		return
 	}
-
-	rply = <-fs.cmdChan
-	if strings.Contains(rply, "-ERR") {
+	var open bool
+	select {
+	case rply, open = <-rplyChan:
+	case <-ctx.Done():
+		// the reply will still be delivered on the buffered rplyChan and discarded
+		return "", ctx.Err()
+	}
+	if !open { // dropped on reconnect
+		return "", errors.New("Connection lost before receiving the reply")
+	}
+	if strings.HasPrefix(strings.TrimSpace(rply), "-ERR") { // only at start, the outputs can quote it
 		return "", errors.New(strings.TrimSpace(rply))
 	}
 	return
 }
 
+// CmdPriority orders the commands waiting to be written on the socket
+type CmdPriority int
+
+const (
+	CmdPriorityNormal CmdPriority = iota
+	CmdPriorityHigh               // Written before the normal priority commands already waiting
+)
+
+type cmdPriorityKey struct{}
+
+// WithCmdPriority returns the context sending the commands with the priority
+func WithCmdPriority(ctx context.Context, prio CmdPriority) context.Context {
+	return context.WithValue(ctx, cmdPriorityKey{}, prio)
+}
+
+// cmdPriority returns the priority set on the context with WithCmdPriority, normal if none
+func cmdPriority(ctx context.Context) CmdPriority {
+	prio, _ := ctx.Value(cmdPriorityKey{}).(CmdPriority)
+	return prio
+}
+
+// cmdQueue lets the commands write on the socket one at a time, the high priority ones before the normal ones
+// With maxInFlight the commands also wait for room among the ones waiting for their replies, so they queue on our side
+type cmdQueue struct {
+	mux         sync.Mutex
+	busy        bool
+	inFlight    int                                  // Commands written and waiting for their replies
+	maxInFlight int                                  // Limits inFlight, 0 for no limit
+	waiting     [CmdPriorityHigh + 1][]chan struct{} // FIFO per priority
+}
+
+// acquire waits for the turn of the command to write, giving up once the context is done
+func (q *cmdQueue) acquire(ctx context.Context, prio CmdPriority) error {
+	if prio < CmdPriorityNormal || prio > CmdPriorityHigh {
+		prio = CmdPriorityNormal
+	}
+	q.mux.Lock()
+	if !q.busy && q.hasRoom() { // nobody waits otherwise, see next
+		q.busy = true
+		q.mux.Unlock()
+		return nil
+	}
+	turn := make(chan struct{})
+	q.waiting[prio] = append(q.waiting[prio], turn)
+	q.mux.Unlock()
+	select {
+	case <-turn:
+		return nil
+	case <-ctx.Done():
+	}
+	q.mux.Lock()
+	for i, waiting := range q.waiting[prio] {
+		if waiting == turn {
+			q.waiting[prio] = append(q.waiting[prio][:i], q.waiting[prio][i+1:]...)
+			q.mux.Unlock()
+			return ctx.Err()
+		}
+	}
+	q.mux.Unlock()
+	q.release() // received the turn meanwhile, pass it on
+	return ctx.Err()
+}
+
+// release ends the write, passing the turn to the next command waiting
+func (q *cmdQueue) release() {
+	q.mux.Lock()
+	q.busy = false
+	q.next()
+	q.mux.Unlock()
+}
+
+// sent counts the commands waiting for their replies, before they are written so the replies cannot come first
+func (q *cmdQueue) sent(n int) {
+	q.mux.Lock()
+	q.inFlight += n
+	q.mux.Unlock()
+}
+
+// replied ends the wait of the commands for their replies, received or lost with the connection
+func (q *cmdQueue) replied(n int) {
+	q.mux.Lock()
+	q.inFlight -= n
+	q.next()
+	q.mux.Unlock()
+}
+
+// setMaxInFlight changes the limit of the commands waiting for their replies, 0 for no limit
+func (q *cmdQueue) setMaxInFlight(maxCmds int) {
+	q.mux.Lock()
+	q.maxInFlight = maxCmds
+	q.next()
+	q.mux.Unlock()
+}
+
+// hasRoom checks if another command can be written, q.mux needs to be locked
+func (q *cmdQueue) hasRoom() bool {
+	return q.maxInFlight <= 0 || q.inFlight < q.maxInFlight
+}
+
+// next passes the turn to the next command waiting, the high priority first, if the write is free and there is room
+// q.mux needs to be locked
+func (q *cmdQueue) next() {
+	if q.busy || !q.hasRoom() {
+		return
+	}
+	for prio := CmdPriorityHigh; prio >= CmdPriorityNormal; prio-- {
+		if len(q.waiting[prio]) != 0 {
+			turn := q.waiting[prio][0]
+			q.waiting[prio] = q.waiting[prio][1:]
+			q.busy = true // for the command receiving the turn
+			close(turn)
+			return
+		}
+	}
+}
+
+// pendingReply is a command waiting for its reply
+type pendingReply struct {
+	rplyChan chan string
+	api      bool // the api commands are replied with api/response, the others with command/reply
+}
+
+// sendWithReply writes the command, in the turn of its priority, and queues the channel on which its reply will be delivered
+func (fs *FSock) sendWithReply(ctx context.Context, cmd string) (rplyChan chan string, err error) {
+	rplyChan = make(chan string, 1) // buffered so the reader never blocks on abandoned replies
+	if err = fs.cmdQueue.acquire(ctx, cmdPriority(ctx)); err != nil {
+		return nil, err
+	}
+	defer fs.cmdQueue.release()
+	fs.cmdQueue.sent(1)
+	fs.rplyMux.Lock()
+	fs.rplyChans = append(fs.rplyChans, pendingReply{rplyChan: rplyChan, api: strings.HasPrefix(cmd, "api ")})
+	fs.rplyMux.Unlock()
+	if err = fs.send(cmd); err != nil {
+		fs.rplyMux.Lock()
+		for i, pending := range fs.rplyChans { // not found if dropped meanwhile with the connection
+			if pending.rplyChan == rplyChan {
+				fs.rplyChans = append(fs.rplyChans[:i], fs.rplyChans[i+1:]...)
+				fs.cmdQueue.replied(1)
+				break
+			}
+		}
+		fs.rplyMux.Unlock()
+		return nil, err
+	}
+	return
+}
+
+// dropPendingReplies closes the channels still waiting for replies lost with the previous connection
+func (fs *FSock) dropPendingReplies() {
+	fs.rplyMux.Lock()
+	rplyChans := fs.rplyChans
+	fs.rplyChans = nil
+	fs.rplyMux.Unlock()
+	fs.cmdQueue.replied(len(rplyChans))
+	for _, pending := range rplyChans {
+		close(pending.rplyChan)
+	}
+}
+
+// deliverReply passes the reply to the oldest command waiting for that kind of reply
+// so a command/reply received in between does not end up as the output of an api command
+func (fs *FSock) deliverReply(rply string, api bool) {
+	fs.rplyMux.Lock()
+	for i, pending := range fs.rplyChans {
+		if pending.api != api {
+			continue
+		}
+		fs.rplyChans = append(fs.rplyChans[:i], fs.rplyChans[i+1:]...)
+		fs.rplyMux.Unlock()
+		fs.cmdQueue.replied(1)
+		pending.rplyChan <- rply
+		return
+	}
+	fs.rplyMux.Unlock()
+	fs.logger.Warning(fmt.Sprintf("<FSock> Received reply with no command waiting: <%s>", rply))
+}
+
 // Generic proxy for commands
 func (fs *FSock) SendCmd(cmdStr string) (string, error) {
 	return fs.sendCmd(cmdStr + "\n")
 }
 
 func (fs *FSock) SendCmdWithArgs(cmd string, args map[string]string, body string) (string, error) {
+	return fs.sendCmd(cmdWithArgs(cmd, args, body))
+}
+
+// cmdWithArgs appends the arguments as headers and the body to the command
+func cmdWithArgs(cmd string, args map[string]string, body string) string {
 	for k, v := range args {
 		cmd += k + ": " + v + "\n"
 	}
 	if len(body) != 0 {
 		cmd += "\n" + body + "\n"
 	}
-	return fs.sendCmd(cmd)
+	return cmd
 }
 
 // Send API command
 func (fs *FSock) SendApiCmd(cmdStr string) (string, error) {
-	return fs.sendCmd("api " + cmdStr + "\n")
+	ctx, cancel := fs.cmdCtx()
+	defer cancel()
+	return fs.SendApiCmdCtx(ctx, cmdStr)
+}
+
+// SendApiCmdWithPriority sends the API command, the high priority ones are written before the normal ones waiting
+// The commands wait on our side only while writing, or with SetMaxInFlightCmds while FreeSWITCH works on the ones written
+func (fs *FSock) SendApiCmdWithPriority(cmdStr string, prio CmdPriority) (string, error) {
+	ctx, cancel := fs.cmdCtx()
+	defer cancel()
+	return fs.SendApiCmdCtx(WithCmdPriority(ctx, prio), cmdStr)
+}
+
+// SendApiCmdBytes sends the API command returning the reply body byte-for-byte, for binary outputs
+func (fs *FSock) SendApiCmdBytes(cmdStr string) ([]byte, error) {
+	rply, err := fs.SendApiCmd(cmdStr)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(rply), nil
+}
+
+// SendApiCmdf formats the API command according to the format specifier before sending it
+func (fs *FSock) SendApiCmdf(format string, args ...interface{}) (string, error) {
+	return fs.SendApiCmd(fmt.Sprintf(format, args...))
+}
+
+// SendApiCmdCtx sends the API command, giving up on the reply once the context is done
+func (fs *FSock) SendApiCmdCtx(ctx context.Context, cmdStr string) (rply string, err error) {
+	if rply, has := fs.cachedApiRply(cmdStr); has {
+		return rply, nil
+	}
+	fs.fsMutex.RLock()
+	retries := fs.apiRetries
+	fs.fsMutex.RUnlock()
+	delayFunc := fib()
+	for i := 0; ; i++ {
+		if rply, err = fs.sendCmdCtx(ctx, "api "+cmdStr+"\n"); err == nil ||
+			i >= retries || !fs.isTransientApiErr(err) {
+			break
+		}
+		fs.logger.Warning(fmt.Sprintf("<FSock> Retrying API command <%s> after error: <%s>", cmdStr, err.Error()))
+		fs.sleepFor(time.Duration(delayFunc()) * ApiRetryDelay)
+	}
+	if err != nil {
+		return
+	}
+	fs.cacheApiRply(cmdStr, rply)
+	return
+}
+
+// Ping checks that FreeSWITCH replies to a cheap API command before the context is done
+func (fs *FSock) Ping(ctx context.Context) (err error) {
+	_, err = fs.sendCmdCtx(ctx, "api status\n") // neither cached nor retried
+	return
+}
+
+// ChannelExists checks with uuid_exists if the channel is still up, the error reports only the failed command
+func (fs *FSock) ChannelExists(uuid string) (exists bool, err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("uuid_exists " + uuid); err != nil {
+		return
+	}
+	switch strings.TrimSpace(rply) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("Unexpected uuid_exists reply received: <%s>", strings.TrimSpace(rply))
+}
+
+// Hangup kills the channel with the hangup cause, NORMAL_CLEARING if empty
+func (fs *FSock) Hangup(uuid, cause string) (err error) {
+	if cause == "" {
+		cause = "NORMAL_CLEARING"
+	}
+	var rply string
+	if rply, err = fs.SendApiCmd("uuid_kill " + uuid + " " + cause); err != nil {
+		if strings.Contains(err.Error(), "No such channel") {
+			return fmt.Errorf("%w <%s>", ErrNoSuchChannel, uuid)
+		}
+		return
+	}
+	if !strings.HasPrefix(rply, "+OK") {
+		return fmt.Errorf("Unexpected uuid_kill reply received: <%s>", strings.TrimSpace(rply))
+	}
+	return
+}
+
+// HangupMsg hangs up the channel with the hangup cause through sendmsg, NORMAL_CLEARING if empty
+// An empty uuid hangs up the session of an outbound socket
+func (fs *FSock) HangupMsg(uuid, cause string) error {
+	if cause == "" {
+		cause = "NORMAL_CLEARING"
+	}
+	return fs.SendMsgCmd(uuid, map[string]string{
+		"call-command": "hangup",
+		"hangup-cause": cause,
+	})
+}
+
+// Bridge bridges the two channels with uuid_bridge
+// The error names the channel FreeSWITCH complained about, when it can be told
+func (fs *FSock) Bridge(uuidA, uuidB string) (err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("uuid_bridge " + uuidA + " " + uuidB); err != nil {
+		switch {
+		case uuidB != "" && strings.Contains(err.Error(), uuidB):
+			return fmt.Errorf("Bridge of <%s> with <%s> failed on <%s>: %w", uuidA, uuidB, uuidB, err)
+		case uuidA != "" && strings.Contains(err.Error(), uuidA):
+			return fmt.Errorf("Bridge of <%s> with <%s> failed on <%s>: %w", uuidA, uuidB, uuidA, err)
+		}
+		return fmt.Errorf("Bridge of <%s> with <%s> failed: %w", uuidA, uuidB, err)
+	}
+	if !strings.HasPrefix(rply, "+OK") {
+		return fmt.Errorf("Unexpected uuid_bridge reply received: <%s>", strings.TrimSpace(rply))
+	}
+	return
+}
+
+// AttXfer starts the attended transfer of the channel to dest, executing att_xfer on it
+func (fs *FSock) AttXfer(uuid, dest string) (err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("uuid_transfer " + uuid + " 'att_xfer:" + dest + "' inline"); err != nil {
+		if strings.Contains(err.Error(), "No such channel") {
+			return fmt.Errorf("%w <%s>", ErrNoSuchChannel, uuid)
+		}
+		return fmt.Errorf("Attended transfer of <%s> to <%s> failed: %w", uuid, dest, err)
+	}
+	if !strings.HasPrefix(rply, "+OK") {
+		return fmt.Errorf("Unexpected uuid_transfer reply received: <%s>", strings.TrimSpace(rply))
+	}
+	return
+}
+
+// Pause stops FreeSWITCH from accepting new calls, with fsctl pause
+func (fs *FSock) Pause() error {
+	return fs.sendApiCmdOK("fsctl pause")
+}
+
+// Resume lets FreeSWITCH accept new calls again, with fsctl resume
+func (fs *FSock) Resume() error {
+	return fs.sendApiCmdOK("fsctl resume")
+}
+
+// HupAll kills all the channels with the hangup cause, NORMAL_CLEARING if empty
+func (fs *FSock) HupAll(cause string) error {
+	if cause == "" {
+		cause = "NORMAL_CLEARING"
+	}
+	return fs.sendApiCmdOK("hupall " + cause)
+}
+
+// sendApiCmdOK sends the API command expecting a +OK reply
+func (fs *FSock) sendApiCmdOK(cmdStr string) (err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd(cmdStr); err != nil {
+		return
+	}
+	if !strings.HasPrefix(rply, "+OK") {
+		return fmt.Errorf("Unexpected %s reply received: <%s>", cmdStr, strings.TrimSpace(rply))
+	}
+	return
+}
+
+// ActiveChannels returns the channels listed by show channels
+func (fs *FSock) ActiveChannels() (chans []ChannelInfo, err error) {
+	return fs.FindChannels(nil)
+}
+
+// FindChannels returns the active channels matching exactly all the values in match
+// The keys of match are the columns of show channels, like cid_num or context
+func (fs *FSock) FindChannels(match map[string]string) (chans []ChannelInfo, err error) {
+	var rply string
+	if rply, err = fs.SendApiCmd("show channels"); err != nil {
+		return
+	}
+	chnsData := MapChanData(rply)
+	chans = make([]ChannelInfo, 0, len(chnsData))
+	for _, chnData := range chnsData {
+		if channelMatches(chnData, match) {
+			chans = append(chans, newChannelInfo(chnData))
+		}
+	}
+	return
+}
+
+// channelMatches checks that the channel data has all the values in match
+func channelMatches(chnData, match map[string]string) bool {
+	for col, val := range match {
+		if chnVal, has := chnData[col]; !has || chnVal != val {
+			return false
+		}
+	}
+	return true
+}
+
+// SendApiCmdWithTrace sends the API command with the traceID as Event-UUID header so it can be found in FreeSWITCH logs
+func (fs *FSock) SendApiCmdWithTrace(cmdStr, traceID string) (string, error) {
+	return fs.sendCmd("api " + cmdStr + "\nEvent-UUID: " + traceID + "\n")
+}
+
+// cachedApiRply returns the reply of the command if cached and not expired
+func (fs *FSock) cachedApiRply(cmdStr string) (rply string, has bool) {
+	fs.fsMutex.RLock()
+	defer fs.fsMutex.RUnlock()
+	if fs.apiCacheTTL == 0 || !fs.apiCacheCmds[cmdStr] {
+		return
+	}
+	item, has := fs.apiCache[cmdStr]
+	if !has || time.Now().After(item.expires) {
+		return "", false
+	}
+	return item.rply, true
+}
+
+// cacheApiRply caches the reply if the command is cacheable
+func (fs *FSock) cacheApiRply(cmdStr, rply string) {
+	fs.fsMutex.Lock()
+	if fs.apiCacheTTL != 0 && fs.apiCacheCmds[cmdStr] {
+		fs.apiCache[cmdStr] = &apiCacheItem{rply: rply, expires: time.Now().Add(fs.apiCacheTTL)}
+	}
+	fs.fsMutex.Unlock()
 }
 
 // Send BGAPI command
 func (fs *FSock) SendBgapiCmd(cmdStr string) (out chan string, err error) {
 	jobUUID := genUUID()
-	out = make(chan string)
+	out = make(chan string, 1) // so doBackgroundJob does not block on the jobs no longer waited for
 
 	fs.fsMutex.Lock()
 	fs.backgroundChans[jobUUID] = out
 	fs.fsMutex.Unlock()
 
-	_, err = fs.sendCmd("bgapi " + cmdStr + "\nJob-UUID:" + jobUUID + "\n")
-	if err != nil {
+	var rply string
+	if rply, err = fs.sendCmd("bgapi " + cmdStr + "\nJob-UUID:" + jobUUID + "\n"); err != nil {
+		fs.fsMutex.Lock()
+		delete(fs.backgroundChans, jobUUID)
+		fs.fsMutex.Unlock()
 		return nil, err
 	}
+	if rplyUUID := parseJobUUID(rply); rplyUUID != "" && rplyUUID != jobUUID {
+		// FreeSWITCH did not use our Job-UUID, wait for the job under the one it replied with
+		fs.fsMutex.Lock()
+		delete(fs.backgroundChans, jobUUID)
+		fs.backgroundChans[rplyUUID] = out
+		fs.fsMutex.Unlock()
+	}
 	return
 }
 
+// WaitBgJob waits for the output of the background job started with SendBgapiCmd
+// Returns ErrBgJobLost if the connection is lost before the job finished
+func WaitBgJob(ctx context.Context, out <-chan string) (string, error) {
+	select {
+	case rply, ok := <-out:
+		if !ok {
+			return "", ErrBgJobLost
+		}
+		return rply, nil
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// OriginateAndWait originates the call to dest, connected to app once answered, waiting for the answer
+// The channel is created with our own origination_uuid so its events can be followed with SubscribeUUID
+// Returns the channel UUID once CHANNEL_ANSWER is received or an error if the channel hangs up first
+// On context done the channel is hung up with ORIGINATOR_CANCEL
+// The events needed, BACKGROUND_JOB included, are subscribed only for the duration of the call unless already subscribed, like with ALL
+// The Event-Name filters need to let BACKGROUND_JOB through since the failures creating no channel are only reported by it
+func (fs *FSock) OriginateAndWait(ctx context.Context, dest, app string, vars map[string]string) (uuid string, err error) {
+	uuid = genUUID()
+	events, cancel := fs.SubscribeUUID(uuid)
+	defer cancel()
+	tempEvents := []string{"CHANNEL_ANSWER", "CHANNEL_HANGUP"}
+	if !fs.bgapiSubsc {
+		tempEvents = append(tempEvents, "BACKGROUND_JOB")
+	}
+	if err = fs.subscribeTemp(tempEvents); err != nil {
+		return "", err
+	}
+	defer fs.unsubscribeTemp(tempEvents)
+	chanVars := make([]string, 0, len(vars))
+	for key, val := range vars {
+		chanVars = append(chanVars, key+"="+strings.ReplaceAll(val, ",", "\\,"))
+	}
+	sort.Strings(chanVars)
+	chanVars = append([]string{"origination_uuid=" + uuid}, chanVars...)
+	var jobOut chan string
+	if jobOut, err = fs.SendBgapiCmd("originate {" + strings.Join(chanVars, ",") + "}" + dest + " " + app); err != nil {
+		return "", err
+	}
+	for {
+		select {
+		case ev, open := <-events:
+			if !open {
+				return "", fmt.Errorf("Originate to <%s> failed: events subscription canceled", dest)
+			}
+			switch ev.Name {
+			case "CHANNEL_ANSWER":
+				return uuid, nil
+			case "CHANNEL_HANGUP":
+				return "", fmt.Errorf("Originate to <%s> failed: <%s>", dest, ev.Get("Hangup-Cause"))
+			}
+		case out, open := <-jobOut:
+			if !open {
+				return "", ErrBgJobLost
+			}
+			if strings.HasPrefix(out, "-ERR") {
+				return "", fmt.Errorf("Originate to <%s> failed: <%s>", dest, strings.TrimSpace(out))
+			}
+			jobOut = nil // answered, wait for the CHANNEL_ANSWER event
+		case <-ctx.Done():
+			fs.Hangup(uuid, "ORIGINATOR_CANCEL")
+			return "", ctx.Err()
+		}
+	}
+}
+
 // SendMsgCmdWithBody command
-func (fs *FSock) SendMsgCmdWithBody(uuid string, cmdargs map[string]string, body string) (err error) {
+func (fs *FSock) SendMsgCmdWithBody(uuid string, cmdargs map[string]string, body string) error {
+	ctx, cancel := fs.cmdCtx()
+	defer cancel()
+	return fs.sendMsgCmd(ctx, uuid, cmdargs, body)
+}
+
+// SendMsgCmd command, an empty uuid targets the session of an outbound socket
+func (fs *FSock) SendMsgCmd(uuid string, cmdargs map[string]string) error {
+	ctx, cancel := fs.cmdCtx()
+	defer cancel()
+	return fs.SendMsgCmdCtx(ctx, uuid, cmdargs)
+}
+
+// SendMsgCmdCtx sends the sendmsg command, giving up on the reply once the context is done
+func (fs *FSock) SendMsgCmdCtx(ctx context.Context, uuid string, cmdargs map[string]string) error {
+	return fs.sendMsgCmd(ctx, uuid, cmdargs, "")
+}
+
+// AppCmd is a dialplan application executed on a channel
+type AppCmd struct {
+	Name string
+	Args string
+}
+
+// ExecuteAppSeq executes the applications on the channel one after the other, in the given order
+// Each one is sent with event-lock and only after the reply of the previous one
+func (fs *FSock) ExecuteAppSeq(uuid string, apps []AppCmd) (err error) {
+	for _, app := range apps {
+		cmdargs := map[string]string{
+			"call-command":     "execute",
+			"execute-app-name": app.Name,
+			"event-lock":       "true",
+		}
+		if len(app.Args) != 0 {
+			cmdargs["execute-app-arg"] = app.Args
+		}
+		if err = fs.SendMsgCmd(uuid, cmdargs); err != nil {
+			return fmt.Errorf("Cannot execute application <%s>: %w", app.Name, err)
+		}
+	}
+	return
+}
+
+// SendMsgCmdAsync sends the sendmsg command without waiting for its reply
+// The reply is still consumed in order so it does not reach other commands
+func (fs *FSock) SendMsgCmdAsync(uuid string, cmdargs map[string]string) (err error) {
 	if len(cmdargs) == 0 {
 		return errors.New("Need command arguments")
 	}
-	_, err = fs.SendCmdWithArgs("sendmsg "+uuid+"\n", cmdargs, body)
+	var cmd string
+	if cmd, err = sendMsgCmdStr(uuid, fs.withEventLock(cmdargs), "", fs.msgURLEncoding()); err != nil {
+		return
+	}
+	if err = fs.ReconnectIfNeeded(); err != nil {
+		return
+	}
+	_, err = fs.sendWithReply(context.Background(), cmd) // reply discarded on the buffered channel
 	return
 }
 
-// SendMsgCmd command
-func (fs *FSock) SendMsgCmd(uuid string, cmdargs map[string]string) error {
-	return fs.SendMsgCmdWithBody(uuid, cmdargs, "")
+func (fs *FSock) sendMsgCmd(ctx context.Context, uuid string, cmdargs map[string]string, body string) (err error) {
+	if len(cmdargs) == 0 {
+		return errors.New("Need command arguments")
+	}
+	var cmd string
+	if cmd, err = sendMsgCmdStr(uuid, fs.withEventLock(cmdargs), body, fs.msgURLEncoding()); err != nil {
+		return
+	}
+	_, err = fs.sendRawCmdCtx(ctx, cmd)
+	return
 }
 
-// SendEventWithBody command
-func (fs *FSock) SendEventWithBody(eventSubclass string, eventParams map[string]string, body string) (string, error) {
-	// Event-Name is overrided to CUSTOM by FreeSWITCH,
-	// so we use Event-Subclass instead
-	eventParams["Event-Subclass"] = eventSubclass
-	return fs.SendCmdWithArgs("sendevent "+eventSubclass+"\n", eventParams, body)
+// SetMsgURLEncoding URL-encodes the values of the sendmsg headers so they can hold new lines
+// Otherwise values with new lines are refused since they would break the command framing
+func (fs *FSock) SetMsgURLEncoding(enabled bool) {
+	var urlEncode int32
+	if enabled {
+		urlEncode = 1
+	}
+	atomic.StoreInt32(&fs.msgURLEncode, urlEncode)
 }
 
-// SendEvent command
-func (fs *FSock) SendEvent(eventSubclass string, eventParams map[string]string) (string, error) {
-	return fs.SendEventWithBody(eventSubclass, eventParams, "")
+func (fs *FSock) msgURLEncoding() bool {
+	return atomic.LoadInt32(&fs.msgURLEncode) == 1
 }
 
-// ReadEvents reads events from socket, attempt reconnect if disconnected
-func (fs *FSock) ReadEvents() (err error) {
-	for {
-		if err = <-fs.errReadEvents; err == io.EOF { // Disconnected, try reconnect
-			if err = fs.ReconnectIfNeeded(); err != nil {
-				return
-			}
+// SetDefaultEventLock sends the sendmsg execute commands with event-lock: true, so the applications run in order
+// The commands setting event-lock themselves keep their value, event-lock: false turning it off for one command
+func (fs *FSock) SetDefaultEventLock(enabled bool) {
+	var eventLock int32
+	if enabled {
+		eventLock = 1
+	}
+	atomic.StoreInt32(&fs.eventLock, eventLock)
+}
+
+// withEventLock adds event-lock to the execute commands if enabled by SetDefaultEventLock and not set already
+// The arguments are copied so the map of the caller stays unchanged
+func (fs *FSock) withEventLock(cmdargs map[string]string) map[string]string {
+	if atomic.LoadInt32(&fs.eventLock) == 0 || cmdargs["call-command"] != "execute" {
+		return cmdargs
+	}
+	for k := range cmdargs {
+		if strings.EqualFold(k, "event-lock") {
+			return cmdargs
+		}
+	}
+	withLock := make(map[string]string, len(cmdargs)+1)
+	for k, v := range cmdargs {
+		withLock[k] = v
+	}
+	withLock["event-lock"] = "true"
+	return withLock
+}
+
+// SetVar sets the channel variable, executing the set application
+func (fs *FSock) SetVar(uuid, name, value string) error {
+	return fs.SendMsgCmd(uuid, map[string]string{
+		"call-command":     "execute",
+		"execute-app-name": "set",
+		"execute-app-arg":  name + "=" + value,
+	})
+}
+
+// sendMsgCmdStr builds the sendmsg command
+// The body is sent framed by content-length so it can hold large application arguments
+func sendMsgCmdStr(uuid string, cmdargs map[string]string, body string, urlEncode bool) (string, error) {
+	cmd := "sendmsg"
+	if uuid != "" { // without UUID it applies to the session of the outbound socket
+		cmd += " " + uuid
+	}
+	cmd += "\n"
+	hasContentType := false
+	for k, v := range cmdargs {
+		if len(body) != 0 && strings.EqualFold(k, "content-length") {
+			continue // computed from body
+		}
+		if urlEncode {
+			v = URLEncode(v)
+		} else if strings.ContainsAny(v, "\r\n") {
+			return "", fmt.Errorf("Invalid value of sendmsg header <%s>: new lines need URL-encoding", k)
+		}
+		hasContentType = hasContentType || strings.EqualFold(k, "content-type")
+		cmd += k + ": " + v + "\n"
+	}
+	if len(body) == 0 {
+		return cmd + "\n", nil
+	}
+	if !hasContentType {
+		cmd += "content-type: text/plain\n"
+	}
+	return cmd + "content-length: " + strconv.Itoa(len(body)) + "\n\n" + body, nil
+}
+
+// SendEventWithBody command
+func (fs *FSock) SendEventWithBody(eventSubclass string, eventParams map[string]string, body string) (string, error) {
+	// Event-Name is overrided to CUSTOM by FreeSWITCH,
+	// so we use Event-Subclass instead
+	eventParams["Event-Subclass"] = eventSubclass
+	return fs.SendCmdWithArgs("sendevent "+eventSubclass+"\n", eventParams, body)
+}
+
+// SendEvent command
+func (fs *FSock) SendEvent(eventSubclass string, eventParams map[string]string) (string, error) {
+	return fs.SendEventWithBody(eventSubclass, eventParams, "")
+}
+
+// ReadEvents reads events from socket, attempt reconnect if disconnected
+// Returns nil once the FSock is closed, it can be called again after Connect or Reconnect
+// Any connection lost, closed by FreeSWITCH, reset or disconnected locally, is reconnected
+// The error is returned once the reconnects run out
+func (fs *FSock) ReadEvents() (err error) {
+	if err = fs.ReconnectIfNeeded(); err != nil { // not connected yet if created lazy
+		if err == ErrClosed { // nothing to read until connected again
+			err = nil
+		}
+		return
+	}
+	for {
+		fs.fsMutex.RLock()
+		errReadEvents, closed := fs.errReadEvents, fs.closed
+		fs.fsMutex.RUnlock()
+		select {
+		case <-closed:
+			return nil
+		case <-errReadEvents: // the reader stops on any error, the stream being unusable
+		}
+		if err = fs.ReconnectIfNeeded(); err != nil { // Disconnected, try reconnect
+			if err == ErrClosed { // closed while the reader was failing
+				err = nil
+			}
+			return
+		}
+	}
+}
+
+func (fs *FSock) LocalAddr() net.Addr {
+	if !fs.Connected() {
+		return nil
+	}
+	return fs.conn.LocalAddr()
+}
+
+// Reads headers until delimiter reached
+func (fs *FSock) readHeaders() (header string, err error) {
+	bytesRead := make([]byte, 0)
+	var readLine []byte
+
+	for {
+		readLine, err = fs.buffer.ReadBytes('\n')
+		if err != nil {
+			err = fs.readErr(err, "headers")
+			fs.Disconnect()
+			return
+		}
+		// No Error, add received to localread buffer
+		if len(bytes.TrimSpace(readLine)) == 0 { // empty line delimiting the headers, either \n or \r\n
+			break
+		}
+		bytesRead = append(append(bytesRead, bytes.TrimRight(readLine, "\r\n")...), '\n') // normalize CRLF line endings
+
+	}
+	if fs.tracing() {
+		fs.logger.Debug(fmt.Sprintf("<FSock> Received headers: <%s>", bytesRead))
+	}
+	return string(bytesRead), nil
+}
+
+// readErr logs the error reading what, returning ErrConnectionClosed for the clean close of the socket by the peer
+func (fs *FSock) readErr(err error, what string) error {
+	if err == io.EOF {
+		fs.logger.Info("<FSock> Connection closed by FreeSWITCH")
+		return ErrConnectionClosed
+	}
+	fs.logger.Err(fmt.Sprintf("<FSock> Error reading %s: <%s>", what, err.Error()))
+	return err
+}
+
+// Reads the body from buffer, ln is given by content-length of headers
+func (fs *FSock) readBody(noBytes int) (body string, err error) {
+	bytesRead := fs.bodyBuf // reused between the bodies, they are read by one goroutine at a time
+	if cap(bytesRead) < noBytes {
+		bytesRead = make([]byte, noBytes)
+		if noBytes <= maxBodyBufSize {
+			fs.bodyBuf = bytesRead
+		}
+	}
+	bytesRead = bytesRead[:noBytes]
+	if _, err = io.ReadFull(fs.buffer, bytesRead); err != nil {
+		err = fs.readErr(err, "message body")
+		fs.Disconnect()
+		return
+	}
+	if fs.tracing() {
+		fs.logger.Debug(fmt.Sprintf("<FSock> Received body: <%s>", bytesRead))
+	}
+	return string(bytesRead), nil
+}
+
+// LastActivity returns the time the last frame was received from FreeSWITCH
+func (fs *FSock) LastActivity() time.Time {
+	lastActivity := atomic.LoadInt64(&fs.lastActivity)
+	if lastActivity == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, lastActivity)
+}
+
+// Event is made out of headers and body (if present)
+func (fs *FSock) readEvent() (header string, body string, err error) {
+	if header, err = fs.readHeaders(); err != nil {
+		return
+	}
+	defer func() { fs.keepFrame(header, body) }() // also the frames failing to parse
+	atomic.StoreInt64(&fs.lastActivity, time.Now().UnixNano())
+	clStr, hasBody := headerValue(header, "Content-Length")
+	if !hasBody {
+		return
+	}
+	var cl int
+	if cl, err = strconv.Atoi(clStr); err != nil {
+		err = fmt.Errorf("Cannot extract content length because<%s>", err)
+		return
+	}
+	fs.fsMutex.RLock()
+	bodyStreamer := fs.bodyStreamer
+	stream := bodyStreamer != nil && cl > fs.maxBodySize &&
+		strings.Contains(header, "text/event-plain") // replies are always read as a whole
+	fs.fsMutex.RUnlock()
+	if stream && !fs.peekBackgroundJob(cl) { // the bgapi outputs reach their SendBgapiCmd channel as a whole
+		err = fs.streamBody(header, cl, bodyStreamer)
+		return
+	}
+	body, err = fs.readBody(cl)
+	return
+}
+
+// peekBackgroundJob checks, without consuming the body, if the event it starts with is a BACKGROUND_JOB
+func (fs *FSock) peekBackgroundJob(noBytes int) bool {
+	if noBytes > fs.buffer.Size() {
+		noBytes = fs.buffer.Size()
+	}
+	head, _ := fs.buffer.Peek(noBytes) // the errors are returned by the read of the body
+	headers := string(head)
+	if idx := strings.Index(headers, "\n\n"); idx != -1 {
+		headers = headers[:idx+1]
+	}
+	return eventName(headers) == "BACKGROUND_JOB"
+}
+
+// RawFrame is a frame as read from the socket, kept for debugging
+type RawFrame struct {
+	Header string
+	Body   string
+}
+
+// SetFrameHistory keeps the last size frames read, returned by RecentFrames
+// A size of 0 disables it
+func (fs *FSock) SetFrameHistory(size int) {
+	fs.framesMux.Lock()
+	fs.framesSize = size
+	if len(fs.frames) > size {
+		fs.frames = fs.frames[len(fs.frames)-size:]
+	}
+	fs.framesMux.Unlock()
+}
+
+// RecentFrames returns the last frames read, oldest first
+func (fs *FSock) RecentFrames() []RawFrame {
+	fs.framesMux.Lock()
+	defer fs.framesMux.Unlock()
+	return append([]RawFrame{}, fs.frames...)
+}
+
+// keepFrame stores the frame if the history is enabled
+func (fs *FSock) keepFrame(header, body string) {
+	fs.framesMux.Lock()
+	if fs.framesSize != 0 {
+		if len(fs.frames) == fs.framesSize {
+			fs.frames = fs.frames[1:]
+		}
+		fs.frames = append(fs.frames, RawFrame{Header: header, Body: body})
+	}
+	fs.framesMux.Unlock()
+}
+
+// SetUndispatchedHistory keeps the last size events received without any handler, returned by UndispatchedEvents
+// A size of 0 disables it
+func (fs *FSock) SetUndispatchedHistory(size int) {
+	fs.framesMux.Lock()
+	fs.deadSize = size
+	if len(fs.deadEvents) > size {
+		fs.deadEvents = fs.deadEvents[len(fs.deadEvents)-size:]
+	}
+	fs.framesMux.Unlock()
+}
+
+// UndispatchedEvents returns the last events received without any handler, oldest first
+// Their Timestamp tells when FreeSWITCH fired them
+func (fs *FSock) UndispatchedEvents() []*Event {
+	fs.framesMux.Lock()
+	defer fs.framesMux.Unlock()
+	return append([]*Event{}, fs.deadEvents...)
+}
+
+// keepUndispatched stores the event if the history of the undispatched events is enabled
+func (fs *FSock) keepUndispatched(event string) {
+	fs.framesMux.Lock()
+	if fs.deadSize != 0 {
+		if len(fs.deadEvents) == fs.deadSize {
+			fs.deadEvents = fs.deadEvents[1:]
+		}
+		fs.deadEvents = append(fs.deadEvents, NewEvent(event))
+	}
+	fs.framesMux.Unlock()
+}
+
+// streamBody passes the body to the streamer, discarding whatever the streamer did not read
+func (fs *FSock) streamBody(header string, noBytes int, streamer func(string, io.Reader, int)) (err error) {
+	body := io.LimitReader(fs.buffer, int64(noBytes))
+	streamer(header, body, fs.connIdx)
+	if _, err = io.Copy(ioutil.Discard, body); err != nil {
+		fs.logger.Err(fmt.Sprintf("<FSock> Error reading message body: <%s>", err.Error()))
+		fs.Disconnect()
+	}
+	return
+}
+
+// Read events from network buffer, stop when stopReadEvents is closed, report on errReadEvents on error and exit
+// Receive stopReadEvents and errReadEvents as parameters so we avoid concurrency on using fs.
+func (fs *FSock) readEvents(stopReadEvents chan struct{}, errReadEvents chan error) {
+	dispatch, stopDispatch := fs.eventDispatcher(stopReadEvents)
+	defer stopDispatch()
+	for {
+		select {
+		case <-stopReadEvents:
+			return
+		default: // Unlock waiting here
+		}
+		hdr, body, err := fs.readEvent()
+		if err != nil {
+			fs.disconnected()
+			select {
+			case errReadEvents <- err:
+			case <-stopReadEvents: // nobody waits for errors from a stopped reader
+			}
+			return
+		}
+		fs.handlersMux.RLock()
+		otherFrames, onLog, onDiscNotice := fs.otherFrames, fs.onLog, fs.onDiscNotice
+		fs.handlersMux.RUnlock()
+		contentType := headerVal(hdr, "Content-Type")
+		if contentType == "log/data" && onLog != nil {
+			onLog(headerVal(hdr, "Log-Level"), body)
+			continue
+		}
+		if otherFrames != nil && !knownContentTypes[contentType] {
+			otherFrames(contentType, hdr, body)
+			if contentType != "text/disconnect-notice" { // still handled below
+				continue
+			}
+		}
+		if strings.Contains(hdr, "text/disconnect-notice") { // FreeSWITCH is closing the socket
+			fs.logger.Info("<FSock> Received disconnect notice from FreeSWITCH")
+			if onDiscNotice != nil {
+				onDiscNotice()
+			}
+			fs.Disconnect()
+			fs.disconnected()
+			select {
+			case errReadEvents <- ErrConnectionClosed: // intentional disconnect, handled as a closed connection
+			case <-stopReadEvents:
+			}
+			return
+		}
+		if strings.Contains(hdr, "api/response") {
+			fs.deliverReply(body, true)
+		} else if strings.Contains(hdr, "command/reply") {
+			fs.deliverReply(headerVal(hdr, "Reply-Text"), false)
+		} else if body != "" { // We got a body, could be event, try dispatching it
+			dispatch(body)
+		}
+	}
+}
+
+// knownContentTypes are the Content-Types of the frames handled by the reading, the others are passed to SetOtherFrameHandler
+var knownContentTypes = map[string]bool{"api/response": true, "command/reply": true, "text/event-plain": true}
+
+// SetOtherFrameHandler passes to handler the frames with other Content-Type than api/response, command/reply and text/event-plain,
+// like log/data, instead of dispatching them as events, the text/disconnect-notice still disconnecting afterwards
+// The handler runs on the reading goroutine, a nil handler restores the dispatching
+func (fs *FSock) SetOtherFrameHandler(handler func(contentType, header, body string)) {
+	fs.handlersMux.Lock()
+	fs.otherFrames = handler
+	fs.handlersMux.Unlock()
+}
+
+// OnLog passes to handler the log lines of FreeSWITCH, received after subscribing with SendCmd("log <level>")
+// The level is the Log-Level header, from 0 for console to 7 for debug, the handler running on the reading goroutine
+// It takes precedence over SetOtherFrameHandler for the log/data frames
+func (fs *FSock) OnLog(handler func(level, line string)) {
+	fs.handlersMux.Lock()
+	fs.onLog = handler
+	fs.handlersMux.Unlock()
+}
+
+// OnDisconnectNotice calls handler when FreeSWITCH announces it closes the socket, before the disconnect
+func (fs *FSock) OnDisconnectNotice(handler func()) {
+	fs.handlersMux.Lock()
+	fs.onDiscNotice = handler
+	fs.handlersMux.Unlock()
+}
+
+// EventQueuePolicy decides what happens with the events read while the event queue is full
+type EventQueuePolicy int
+
+const (
+	EventQueueBlock      EventQueuePolicy = iota // Stop reading until there is room, FreeSWITCH queueing the events meanwhile
+	EventQueueDropOldest                         // Keep reading, discarding the oldest queued event
+)
+
+// SetEventQueue dispatches the events out of a queue of size events so slow handlers do not delay the reading of the replies
+// The policy applies when the queue is full, the settings being used from the next connect
+// A size of 0 dispatches the events on the reading goroutine, the synchronous handlers still on their own one
+func (fs *FSock) SetEventQueue(size int, policy EventQueuePolicy) {
+	fs.handlersMux.Lock()
+	fs.evQueueSize, fs.evQueuePolicy = size, policy
+	fs.handlersMux.Unlock()
+}
+
+// eventDispatcher returns the function dispatching the events read, through the event queue if configured,
+// and the one stopping the queue once the reading stops
+func (fs *FSock) eventDispatcher(stopReadEvents chan struct{}) (dispatch func(string), stop func()) {
+	fs.handlersMux.RLock()
+	size, policy := fs.evQueueSize, fs.evQueuePolicy
+	fs.handlersMux.RUnlock()
+	if size <= 0 {
+		return fs.syncDispatcher(stopReadEvents)
+	}
+	queue := make(chan string, size)
+	fs.handlersWg.Add(1)
+	go func() { // dispatches also the events queued before the reading stopped
+		defer fs.handlersWg.Done()
+		for event := range queue {
+			fs.dispatchUntil(event, stopReadEvents)
+		}
+	}()
+	dispatch = func(event string) {
+		if policy == EventQueueBlock {
+			select {
+			case queue <- event:
+			case <-stopReadEvents:
+			}
+			return
+		}
+		for {
+			select {
+			case queue <- event:
+				return
+			default:
+			}
+			select {
+			case dropped := <-queue:
+				atomic.AddUint64(&fs.queueDropped, 1)
+				fs.logger.Warning(fmt.Sprintf("<FSock> Event queue full, dropping event %s", eventName(dropped)))
+			default: // taken meanwhile by the dispatching
+			}
+		}
+	}
+	return dispatch, func() { close(queue) }
+}
+
+// syncDispatcher returns the function dispatching the events read without event queue and the one stopping it
+// The synchronous handlers run in order on their own goroutine, started on first use, so the reading of the replies
+// does not wait for them, the events waiting in an unbounded queue meanwhile
+func (fs *FSock) syncDispatcher(stopReadEvents chan struct{}) (dispatch func(string), stop func()) {
+	var queueMux sync.Mutex
+	var queue []string
+	var ready, done chan struct{} // nil until the first synchronous dispatch
+	runQueued := func() (ran bool) {
+		queueMux.Lock()
+		events := queue
+		queue = nil
+		queueMux.Unlock()
+		for _, event := range events {
+			fs.dispatchUntil(event, stopReadEvents)
+		}
+		return len(events) != 0
+	}
+	dispatch = func(event string) {
+		fs.handlersMux.RLock()
+		syncDispatch := fs.syncDispatch
+		fs.handlersMux.RUnlock()
+		if !syncDispatch {
+			fs.dispatchUntil(event, stopReadEvents)
+			return
+		}
+		if ready == nil {
+			ready, done = make(chan struct{}, 1), make(chan struct{})
+			fs.handlersWg.Add(1)
+			go func() { // dispatches also the events queued before the reading stopped
+				defer fs.handlersWg.Done()
+				for {
+					if runQueued() {
+						continue
+					}
+					select {
+					case <-ready:
+					case <-done:
+						runQueued()
+						return
+					}
+				}
+			}()
+		}
+		queueMux.Lock()
+		queue = append(queue, event)
+		queueMux.Unlock()
+		select {
+		case ready <- struct{}{}:
+		default: // already signaled
+		}
+	}
+	stop = func() {
+		if done != nil {
+			close(done)
+		}
+	}
+	return
+}
+
+// disconnected closes the channels of the pending background jobs and notifies the onDisconnect function, if any
+func (fs *FSock) disconnected() {
+	fs.fsMutex.Lock()
+	onDisconnect := fs.onDisconnect
+	bgChans := fs.backgroundChans
+	if len(bgChans) != 0 { // their BACKGROUND_JOB events will not be received on the next connection
+		fs.backgroundChans = make(map[string]chan string)
+	} else {
+		bgChans = nil // the map stays in use, not read outside the lock
+	}
+	fs.fsMutex.Unlock()
+	if len(bgChans) != 0 {
+		fs.logger.Warning(fmt.Sprintf("<FSock> Connection lost with %d background jobs pending", len(bgChans)))
+		for _, out := range bgChans {
+			close(out)
+		}
+	}
+	if onDisconnect != nil {
+		onDisconnect(fs.connIdx)
+	}
+}
+
+// Subscribe to events
+func (fs *FSock) eventsPlain(events []string, bgapiSubsc bool) (err error) {
+	fs.checkEventNames(events)
+	eventsCmd := eventsPlainCmd(events, bgapiSubsc)
+	if err = fs.send(terminated(eventsCmd)); err != nil {
+		fs.Disconnect()
+		return
+	}
+	var rply string
+	if rply, err = fs.readHeaders(); err != nil {
+		return
+	}
+	if !strings.Contains(rply, "Reply-Text: +OK") {
+		fs.Disconnect()
+		return fmt.Errorf("Unexpected events-subscribe reply received: <%s>", rply)
+	}
+	return
+}
+
+// SetEventNameValidation warns about the subscriptions to event names missing from KnownEventNames
+// FreeSWITCH accepts them silently so a misspelled name would just never receive events
+func (fs *FSock) SetEventNameValidation(enabled bool) {
+	var validate int32
+	if enabled {
+		validate = 1
+	}
+	atomic.StoreInt32(&fs.validateEvents, validate)
+}
+
+// checkEventNames logs the unknown event names if the validation is enabled
+func (fs *FSock) checkEventNames(events []string) {
+	if atomic.LoadInt32(&fs.validateEvents) == 0 {
+		return
+	}
+	for _, ev := range unknownEventNames(events) {
+		fs.logger.Warning(fmt.Sprintf("<FSock> Subscribing to unknown event name <%s>, check it for typos", ev))
+	}
+}
+
+// eventsPlainCmd builds the command subscribing to the events
+// The wildcards are subscribed as the known event names they match, see expandWildcards
+func eventsPlainCmd(events []string, bgapiSubsc bool) string {
+	eventsCmd := "event plain"
+	customEvents := ""
+	hasCustom := false
+	for _, ev := range expandWildcards(events) {
+		if ev == "ALL" {
+			eventsCmd = "event plain all"
+			break
+		}
+		if ev == "CUSTOM" || strings.HasPrefix(ev, "CUSTOM ") {
+			hasCustom = true
+			customEvents += ev[6:] // will capture here also space between CUSTOM and the subclass
+			continue
+		}
+		eventsCmd += " " + ev
+	}
+	if eventsCmd != "event plain all" {
+		if bgapiSubsc {
+			eventsCmd += " BACKGROUND_JOB" // For bgapi
+		}
+		if hasCustom { // Add CUSTOM events subscribing in the end otherwise unexpected events are received
+			eventsCmd += " " + "CUSTOM" + customEvents
+		}
+	}
+	return eventsCmd
+}
+
+// EventFilter filters the events on the value of one header
+type EventFilter struct {
+	Header string
+	Value  string
+}
+
+// AddEventFilters applies the filters in order, multiple values for the same header being allowed
+// The filters are kept so they are applied again on reconnect
+func (fs *FSock) AddEventFilters(filters []EventFilter) (err error) {
+	for _, fltr := range filters {
+		fs.handlersMux.Lock()
+		if fs.eventFilters == nil {
+			fs.eventFilters = make(map[string][]string)
+		}
+		fs.eventFilters[fltr.Header] = append(fs.eventFilters[fltr.Header], fltr.Value)
+		fs.handlersMux.Unlock()
+		if !fs.Connected() { // applied on connect
+			continue
+		}
+		if _, err = fs.sendCmd("filter " + fltr.Header + " " + fltr.Value + "\n"); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// SetMyEvents receives with myevents only the events of the channel, the filters refining them further
+// The myevents and the filters are sent again in the same order on reconnect, an empty uuid drops myevents on the next connect
+func (fs *FSock) SetMyEvents(uuid string, filters ...EventFilter) (err error) {
+	fs.handlersMux.Lock()
+	fs.myEventsUUID = uuid
+	fs.handlersMux.Unlock()
+	if uuid != "" && fs.Connected() {
+		if _, err = fs.sendCmd("myevents plain " + uuid + "\n"); err != nil {
+			return
+		}
+	}
+	return fs.AddEventFilters(filters)
+}
+
+// myEvents subscribes to the events of the channel during the handshake
+func (fs *FSock) myEvents(uuid string) (err error) {
+	if err = fs.send(terminated("myevents plain " + uuid)); err != nil {
+		fs.Disconnect()
+		return
+	}
+	var rply string
+	if rply, err = fs.readHeaders(); err != nil {
+		return
+	}
+	if !strings.Contains(rply, "Reply-Text: +OK") {
+		fs.Disconnect()
+		return fmt.Errorf("Unexpected myevents reply received: <%s>", rply)
+	}
+	return
+}
+
+// subscribedEvents returns the events to subscribe to, sorted
+func (fs *FSock) subscribedEvents() (events []string) {
+	fs.handlersMux.RLock()
+	events = getMapKeys(fs.eventHandlers)
+	for ev := range fs.events {
+		if _, handled := fs.eventHandlers[ev]; !handled {
+			events = append(events, ev)
+		}
+	}
+	for ev := range fs.tempEvents {
+		if _, handled := fs.eventHandlers[ev]; !handled && !fs.events[ev] {
+			events = append(events, ev)
+		}
+	}
+	fs.handlersMux.RUnlock()
+	sort.Strings(events)
+	return
+}
+
+// AddEvents adds the events to the subscription, sending only the ones not already subscribed
+// The events are kept subscribed on reconnects
+func (fs *FSock) AddEvents(events ...string) (err error) {
+	fs.handlersMux.Lock()
+	if fs.events == nil {
+		fs.events = make(map[string]bool)
+	}
+	var newEvents []string
+	for _, ev := range events {
+		_, handled := fs.eventHandlers[ev]
+		if !handled && !fs.events[ev] {
+			newEvents = append(newEvents, ev)
+		}
+		fs.events[ev] = true
+	}
+	fs.handlersMux.Unlock()
+	if len(newEvents) == 0 || !fs.Connected() { // subscribed on connect
+		return
+	}
+	fs.checkEventNames(newEvents)
+	_, err = fs.sendCmd(eventsPlainCmd(newEvents, false) + "\n")
+	return
+}
+
+// subscribeTemp subscribes to the events not already subscribed, until the matching unsubscribeTemp
+func (fs *FSock) subscribeTemp(events []string) (err error) {
+	fs.handlersMux.Lock()
+	if fs.tempEvents == nil {
+		fs.tempEvents = make(map[string]int)
+	}
+	var newEvents []string
+	for _, ev := range events {
+		if !fs.subscribedLocked(ev) {
+			newEvents = append(newEvents, ev)
+		}
+		fs.tempEvents[ev]++
+	}
+	fs.handlersMux.Unlock()
+	if len(newEvents) == 0 || !fs.Connected() { // subscribed on connect
+		return
+	}
+	_, err = fs.sendCmd(eventsPlainCmd(newEvents, false) + "\n")
+	return
+}
+
+// unsubscribeTemp removes with nixevent the events subscribed by subscribeTemp and not needed otherwise
+func (fs *FSock) unsubscribeTemp(events []string) {
+	fs.handlersMux.Lock()
+	var oldEvents []string
+	for _, ev := range events {
+		if fs.tempEvents[ev]--; fs.tempEvents[ev] > 0 {
+			continue
+		}
+		delete(fs.tempEvents, ev)
+		if !fs.subscribedLocked(ev) && (ev != "BACKGROUND_JOB" || !fs.bgapiSubsc) {
+			oldEvents = append(oldEvents, ev)
+		}
+	}
+	fs.handlersMux.Unlock()
+	if len(oldEvents) == 0 || !fs.Connected() {
+		return
+	}
+	if _, err := fs.sendCmd("nixevent " + strings.Join(oldEvents, " ") + "\n"); err != nil {
+		fs.logger.Warning(fmt.Sprintf("<FSock> Cannot unsubscribe from <%s>: %s", strings.Join(oldEvents, " "), err.Error()))
+	}
+}
+
+// subscribedLocked checks if the event is subscribed by the handlers, AddEvents or subscribeTemp, handlersMux needs to be locked
+// The subscriptions to ALL and to the wildcards matching the event cover it too
+func (fs *FSock) subscribedLocked(ev string) bool {
+	if fs.tempEvents[ev] > 0 {
+		return true
+	}
+	for key := range fs.eventHandlers {
+		if subscriptionCovers(key, ev) {
+			return true
+		}
+	}
+	for key := range fs.events {
+		if subscriptionCovers(key, ev) {
+			return true
+		}
+	}
+	return false
+}
+
+// subscriptionCovers checks if subscribing to key subscribes to the event too, as ALL and the matching wildcards do
+func subscriptionCovers(key, ev string) bool {
+	for _, subscribed := range expandWildcards([]string{key}) {
+		if subscribed == "ALL" || subscribed == ev {
+			return true
+		}
+	}
+	return false
+}
+
+// SetEvents replaces the events subscribed with AddEvents or SetEvents, the handled events stay subscribed
+// When connected the subscription is cleared with noevents and sent again
+func (fs *FSock) SetEvents(events ...string) (err error) {
+	fs.handlersMux.Lock()
+	fs.events = make(map[string]bool)
+	for _, ev := range events {
+		fs.events[ev] = true
+	}
+	fs.handlersMux.Unlock()
+	if !fs.Connected() { // subscribed on connect
+		return
+	}
+	if _, err = fs.sendCmd("noevents\n"); err != nil {
+		return
+	}
+	if subscribed := fs.subscribedEvents(); len(subscribed) != 0 || fs.bgapiSubsc {
+		fs.checkEventNames(subscribed)
+		_, err = fs.sendCmd(eventsPlainCmd(subscribed, fs.bgapiSubsc) + "\n")
+	}
+	return
+}
+
+// Enable filters
+func (fs *FSock) filterEvents(filters map[string][]string, bgapiSubsc bool) (err error) {
+	if len(filters) == 0 {
+		return nil
+	}
+	if bgapiSubsc && !isSliceMember(append([]string{}, filters["Event-Name"]...), "BACKGROUND_JOB") {
+		bgFilters := make(map[string][]string) // do not alter the tracked filters
+		for hdr, vals := range filters {
+			bgFilters[hdr] = vals
+		}
+		bgFilters["Event-Name"] = append(append([]string{}, filters["Event-Name"]...), "BACKGROUND_JOB") // for bgapi
+		filters = bgFilters
+	}
+	for hdr, vals := range filters {
+		for _, val := range vals {
+			if err = fs.send(terminated("filter " + hdr + " " + val)); err != nil {
+				fs.Disconnect()
+				return
+			}
+			var rply string
+			if rply, err = fs.readHeaders(); err != nil {
+				return
+			}
+			if !strings.Contains(rply, "Reply-Text: +OK") {
+				fs.Disconnect()
+				return fmt.Errorf("Unexpected filter-events reply received: <%s>", rply)
+			}
+		}
+	}
+	return nil
+}
+
+// replayEvent is an event kept for handlers added later
+type replayEvent struct {
+	name  string
+	event string
+}
+
+// SetEventReplay keeps the last size events so handlers added with AddEventHandlerWithReplay receive them
+// A size of 0 disables the replay
+func (fs *FSock) SetEventReplay(size int) {
+	fs.handlersMux.Lock()
+	fs.replaySize = size
+	if len(fs.replayEvents) > size {
+		fs.replayEvents = fs.replayEvents[len(fs.replayEvents)-size:]
+	}
+	fs.handlersMux.Unlock()
+}
+
+// SetEventAllowlist dispatches only the events with the given names, dropping the others
+// No names disables the allowlist
+func (fs *FSock) SetEventAllowlist(eventNames ...string) {
+	fs.handlersMux.Lock()
+	fs.allowedEvents = make(map[string]bool)
+	for _, evName := range eventNames {
+		fs.allowedEvents[evName] = true
+	}
+	fs.handlersMux.Unlock()
+}
+
+// SetSynchronousDispatch runs the event handlers one after the other on a dispatching goroutine
+// This keeps the events in order with a slow handler delaying the handling of the next ones, not the reading
+// The handlers can wait for commands, with SetEventQueue as long as the queue has room
+func (fs *FSock) SetSynchronousDispatch(enabled bool) {
+	fs.handlersMux.Lock()
+	fs.syncDispatch = enabled
+	fs.handlersMux.Unlock()
+}
+
+// SetEventTransform applies the transform to the events before passing them to the handlers and channels
+// The transform returning nil drops the event, the BACKGROUND_JOB events are not transformed
+// The event is dispatched on the Name of the returned event
+func (fs *FSock) SetEventTransform(transform func(*Event) *Event) {
+	fs.handlersMux.Lock()
+	fs.eventTransform = transform
+	fs.handlersMux.Unlock()
+}
+
+// SetCharsetDecoder converts with decode the url decoded values of the headers received in other charsets than UTF-8
+// With no headers listed all the header values and the event body are decoded, a nil decode restores the passthrough
+func (fs *FSock) SetCharsetDecoder(decode func(string) string, headers ...string) {
+	fs.handlersMux.Lock()
+	fs.charsetDecoder = decode
+	fs.charsetHeaders = headers
+	fs.handlersMux.Unlock()
+}
+
+// SetEventsChanOptions configures the channel returned by EventsChan, call it before EventsChan
+// A size of 0 buffers EventsChanBuffer events, with dropOnFull the events not fitting in the buffer are dropped instead of blocking the reading
+// Without dropOnFull a stalled consumer blocks the reading until it catches up or the FSock is closed or reconnected
+func (fs *FSock) SetEventsChanOptions(size int, dropOnFull bool) {
+	fs.handlersMux.Lock()
+	fs.eventsChanSize = size
+	fs.eventsChanDrop = dropOnFull
+	fs.handlersMux.Unlock()
+}
+
+// EventsChan returns the channel receiving the dispatched events, in addition to the handlers
+func (fs *FSock) EventsChan() <-chan *Event {
+	fs.handlersMux.Lock()
+	defer fs.handlersMux.Unlock()
+	if fs.eventsChan == nil {
+		size := fs.eventsChanSize
+		if size <= 0 {
+			size = EventsChanBuffer
 		}
+		fs.eventsChan = make(chan *Event, size)
 	}
+	return fs.eventsChan
 }
 
-func (fs *FSock) LocalAddr() net.Addr {
-	if !fs.Connected() {
-		return nil
+// SubscribeUUID returns a channel receiving the dispatched events of the Unique-ID and the func canceling the subscription
+// The channel is buffered with UUIDEventsBuffer, events not fitting in it are dropped so the reading is not blocked
+func (fs *FSock) SubscribeUUID(uuid string) (<-chan *Event, func()) {
+	evChan := make(chan *Event, UUIDEventsBuffer)
+	fs.handlersMux.Lock()
+	if fs.uuidSubs == nil {
+		fs.uuidSubs = make(map[string]map[chan *Event]struct{})
+	}
+	if fs.uuidSubs[uuid] == nil {
+		fs.uuidSubs[uuid] = make(map[chan *Event]struct{})
+	}
+	fs.uuidSubs[uuid][evChan] = struct{}{}
+	fs.handlersMux.Unlock()
+	return evChan, func() {
+		fs.handlersMux.Lock()
+		defer fs.handlersMux.Unlock()
+		if _, has := fs.uuidSubs[uuid][evChan]; !has { // already canceled
+			return
+		}
+		delete(fs.uuidSubs[uuid], evChan)
+		if len(fs.uuidSubs[uuid]) == 0 {
+			delete(fs.uuidSubs, uuid)
+		}
+		close(evChan)
 	}
-	return fs.conn.LocalAddr()
 }
 
-// Reads headers until delimiter reached
-func (fs *FSock) readHeaders() (header string, err error) {
-	bytesRead := make([]byte, 0)
-	var readLine []byte
+// AddEventHandler registers the handler for the event, subscribing to it if not already
+// The handlers registered for ALL receive every event, besides the handlers of its name or matching wildcard
+func (fs *FSock) AddEventHandler(eventName string, handler func(string, int)) error {
+	fs.handlersMux.Lock()
+	_, subscribed := fs.eventHandlers[eventName]
+	fs.addEventHandler(eventName, handler)
+	fs.handlersMux.Unlock()
+	return fs.subscribeEvent(eventName, subscribed)
+}
 
-	for {
-		readLine, err = fs.buffer.ReadBytes('\n')
-		if err != nil {
-			fs.logger.Err(fmt.Sprintf("<FSock> Error reading headers: <%s>", err.Error()))
-			fs.Disconnect()
-			return
+// AddEventHandlerWithReplay registers the handler for the event, passing it first the matching events kept for replay
+// The wildcard and ALL handlers are replayed the events they match, like when dispatched
+func (fs *FSock) AddEventHandlerWithReplay(eventName string, handler func(string, int)) error {
+	replayed := make(chan struct{})
+	fs.handlersMux.Lock()
+	_, subscribed := fs.eventHandlers[eventName]
+	var events []string
+	for _, rplEv := range fs.replayEvents {
+		if handlerKeyMatches(eventName, rplEv.name) {
+			events = append(events, rplEv.event)
 		}
-		// No Error, add received to localread buffer
-		if len(bytes.TrimSpace(readLine)) == 0 {
-			break
+	}
+	fs.addEventHandler(eventName, func(event string, connIdx int) {
+		<-replayed // live events only after the replayed ones
+		handler(event, connIdx)
+	})
+	fs.handlersMux.Unlock()
+	go func() {
+		for _, event := range events {
+			fs.handleEvent(handler, eventName, event)
 		}
-		bytesRead = append(bytesRead, readLine...)
+		close(replayed)
+	}()
+	return fs.subscribeEvent(eventName, subscribed)
+}
+
+// addEventHandler registers the handler, handlersMux needs to be locked
+func (fs *FSock) addEventHandler(eventName string, handler func(string, int)) {
+	if fs.eventHandlers == nil {
+		fs.eventHandlers = make(map[string][]func(string, int))
 	}
-	return string(bytesRead), nil
+	fs.eventHandlers[eventName] = append(fs.eventHandlers[eventName], handler)
 }
 
-// Reads the body from buffer, ln is given by content-length of headers
-func (fs *FSock) readBody(noBytes int) (body string, err error) {
-	bytesRead := make([]byte, noBytes)
-	var readByte byte
+// subscribeEvent subscribes to the event if connected and not already subscribed
+// Otherwise the subscription is done on connect
+func (fs *FSock) subscribeEvent(eventName string, subscribed bool) (err error) {
+	if subscribed || !fs.Connected() {
+		return
+	}
+	fs.checkEventNames([]string{eventName})
+	_, err = fs.sendCmd(eventsPlainCmd([]string{eventName}, false) + "\n")
+	return
+}
 
-	for i := 0; i < noBytes; i++ {
-		if readByte, err = fs.buffer.ReadByte(); err != nil {
-			fs.logger.Err(fmt.Sprintf("<FSock> Error reading message body: <%s>", err.Error()))
-			fs.Disconnect()
-			return
+// eventName returns the name of the event, including the subclass for CUSTOM events
+func eventName(event string) (evName string) {
+	evName = headerVal(event, "Event-Name")
+	if evName == "CUSTOM" {
+		eventSubclass := headerVal(event, "Event-Subclass")
+		if len(eventSubclass) != 0 {
+			evName += " " + urlDecode(eventSubclass)
 		}
-		// No Error, add received to local read buffer
-		bytesRead[i] = readByte
 	}
-	return string(bytesRead), nil
+	return
 }
 
-// Event is made out of headers and body (if present)
-func (fs *FSock) readEvent() (header string, body string, err error) {
-	if header, err = fs.readHeaders(); err != nil {
+// SetSequenceTracking detects the gaps in the Event-Sequence of the events, logging them and calling onGap if not nil
+// FreeSWITCH numbers all its events so use it only when subscribed to all of them, without filters
+func (fs *FSock) SetSequenceTracking(enabled bool, onGap func(expected, received uint64)) {
+	fs.seqMux.Lock()
+	fs.seqTrack = enabled
+	fs.onSeqGap = onGap
+	fs.lastSeq = 0
+	fs.seqMux.Unlock()
+}
+
+// trackSequence checks the Event-Sequence of the event against the last one
+func (fs *FSock) trackSequence(event string) {
+	fs.seqMux.Lock()
+	if !fs.seqTrack {
+		fs.seqMux.Unlock()
 		return
 	}
-	if !strings.Contains(header, "Content-Length") { //No body
+	seq, err := strconv.ParseUint(headerVal(event, "Event-Sequence"), 10, 64)
+	if err != nil {
+		fs.seqMux.Unlock()
 		return
 	}
-	var cl int
-	if cl, err = strconv.Atoi(headerVal(header, "Content-Length")); err != nil {
-		err = fmt.Errorf("Cannot extract content length because<%s>", err)
+	expected := fs.lastSeq + 1
+	fs.lastSeq = seq
+	if expected == 1 || seq <= expected { // first event since connect, duplicate or FreeSWITCH restarted
+		fs.seqMux.Unlock()
 		return
 	}
-	body, err = fs.readBody(cl)
-	return
+	fs.droppedEvents += seq - expected
+	onGap := fs.onSeqGap
+	fs.seqMux.Unlock()
+	fs.logger.Warning(fmt.Sprintf("<FSock> Event-Sequence gap, expected %d, received %d", expected, seq))
+	if onGap != nil {
+		onGap(expected, seq)
+	}
+}
+
+// PauseDispatch stops dispatching the events, without unsubscribing from them, until ResumeDispatch
+// Up to hold events are kept meanwhile, the next ones being dropped, hold 0 dropping all
+// The BACKGROUND_JOB events still deliver the bgapi outputs
+func (fs *FSock) PauseDispatch(hold int) {
+	fs.handlersMux.Lock()
+	fs.dispatchPaused, fs.pauseHold = true, hold
+	fs.handlersMux.Unlock()
 }
 
-// Read events from network buffer, stop when exitChan is closed, report on errReadEvents on error and exit
-// Receive exitChan and errReadEvents as parameters so we avoid concurrency on using fs.
-func (fs *FSock) readEvents() {
+// ResumeDispatch dispatches the events held during the pause, in the order read, then the new ones
+func (fs *FSock) ResumeDispatch() {
 	for {
-		select {
-		case <-fs.stopReadEvents:
-			return
-		default: // Unlock waiting here
-		}
-		hdr, body, err := fs.readEvent()
-		if err != nil {
-			fs.errReadEvents <- err
+		fs.handlersMux.Lock()
+		held := fs.heldEvents
+		fs.heldEvents = nil
+		if len(held) == 0 { // the events read while dispatching the held ones stay in order
+			fs.dispatchPaused = false
+			fs.handlersMux.Unlock()
 			return
 		}
-		if strings.Contains(hdr, "api/response") {
-			fs.cmdChan <- body
-		} else if strings.Contains(hdr, "command/reply") {
-			fs.cmdChan <- headerVal(hdr, "Reply-Text")
-		} else if body != "" { // We got a body, could be event, try dispatching it
-			fs.dispatchEvent(body)
+		fs.handlersMux.Unlock()
+		for _, event := range held {
+			fs.dispatchNamed(event, eventName(event), nil)
 		}
 	}
 }
 
-// Subscribe to events
-func (fs *FSock) eventsPlain(events []string, bgapiSubsc bool) (err error) {
-	eventsCmd := "event plain"
-	customEvents := ""
-	for _, ev := range events {
-		if ev == "ALL" {
-			eventsCmd = "event plain all"
-			break
-		}
-		if strings.HasPrefix(ev, "CUSTOM") {
-			customEvents += ev[6:] // will capture here also space between CUSTOM and event
-			continue
-		}
-		eventsCmd += " " + ev
+// holdEvent keeps or drops the event while the dispatch is paused, returning false when not paused
+func (fs *FSock) holdEvent(event, eventName string) bool {
+	fs.handlersMux.Lock()
+	defer fs.handlersMux.Unlock()
+	if !fs.dispatchPaused {
+		return false
 	}
-	if eventsCmd != "event plain all" {
-		if bgapiSubsc {
-			eventsCmd += " BACKGROUND_JOB" // For bgapi
-		}
-		if len(customEvents) != 0 { // Add CUSTOM events subscribing in the end otherwise unexpected events are received
-			eventsCmd += " " + "CUSTOM" + customEvents
-		}
+	if len(fs.heldEvents) >= fs.pauseHold {
+		fs.logger.Debug(fmt.Sprintf("<FSock> Dropping event %s, dispatch paused", eventName))
+		return true
 	}
+	fs.heldEvents = append(fs.heldEvents, event)
+	return true
+}
 
-	if err = fs.send(eventsCmd + "\n\n"); err != nil {
-		fs.Disconnect()
+// Dispatch events to handlers in async mode
+func (fs *FSock) dispatchEvent(event string) {
+	fs.dispatchUntil(event, nil)
+}
+
+// dispatchUntil dispatches the event, giving up on the blocked EventsChan once stop is closed
+func (fs *FSock) dispatchUntil(event string, stop <-chan struct{}) {
+	fs.trackSequence(event)
+	eventName := eventName(event)
+	if eventName == "BACKGROUND_JOB" { // for bgapi BACKGROUND_JOB
+		go fs.doBackgroundJob(event)
 		return
 	}
-	var rply string
-	if rply, err = fs.readHeaders(); err != nil {
+
+	if eventName == "" { // data or log frames, not events
+		fs.logger.Debug(fmt.Sprintf("<FSock> Dropping frame without Event-Name: <%s>", event))
 		return
 	}
-	if !strings.Contains(rply, "Reply-Text: +OK") {
-		fs.Disconnect()
-		return fmt.Errorf("Unexpected events-subscribe reply received: <%s>", rply)
+	if fs.holdEvent(event, eventName) {
+		return
 	}
-	return
+	fs.dispatchNamed(event, eventName, stop)
 }
 
-// Enable filters
-func (fs *FSock) filterEvents(filters map[string][]string, bgapiSubsc bool) (err error) {
-	if len(filters) == 0 {
-		return nil
+// dispatchNamed passes the event to the handlers of its name, past the pause of the dispatch
+func (fs *FSock) dispatchNamed(event, eventName string, stop <-chan struct{}) {
+	fs.handlersMux.RLock()
+	transform, decode, charsetHeaders := fs.eventTransform, fs.charsetDecoder, fs.charsetHeaders
+	fs.handlersMux.RUnlock()
+	if decode != nil {
+		event = decodeCharset(event, decode, charsetHeaders)
 	}
-	if bgapiSubsc {
-		filters["Event-Name"] = append(filters["Event-Name"], "BACKGROUND_JOB") // for bgapi
+	if transform != nil {
+		ev := transform(NewEvent(event))
+		if ev == nil {
+			fs.logger.Debug(fmt.Sprintf("<FSock> Dropping event %s, discarded by the transform", eventName))
+			return
+		}
+		event = ev.String()
+		eventName = ev.Name
 	}
-	for hdr, vals := range filters {
-		for _, val := range vals {
-			if err = fs.send("filter " + hdr + " " + val + "\n\n"); err != nil {
-				fs.Disconnect()
-				return
-			}
-			var rply string
-			if rply, err = fs.readHeaders(); err != nil {
-				return
+
+	fs.handlersMux.Lock()
+	if len(fs.allowedEvents) != 0 && !fs.allowedEvents[eventName] {
+		fs.handlersMux.Unlock()
+		fs.logger.Debug(fmt.Sprintf("<FSock> Dropping event %s, not in the allowlist", eventName))
+		return
+	}
+	if fs.replaySize != 0 {
+		if len(fs.replayEvents) == fs.replaySize {
+			fs.replayEvents = fs.replayEvents[1:]
+		}
+		fs.replayEvents = append(fs.replayEvents, &replayEvent{name: eventName, event: event})
+	}
+	evChan, dropOnFull := fs.eventsChan, fs.eventsChanDrop
+	dispatched := evChan != nil
+	if uuidSubs := fs.uuidSubs[headerVal(event, "Unique-ID")]; len(uuidSubs) != 0 {
+		uuidEv := NewEvent(event)
+		for uuidChan := range uuidSubs { // sent under the lock so cancel does not close the channel meanwhile
+			select {
+			case uuidChan <- uuidEv:
+			default:
+				fs.logger.Warning(fmt.Sprintf("<FSock> UUID events channel full, dropping event %s for %s", eventName, uuidEv.Get("Unique-ID")))
 			}
-			if !strings.Contains(rply, "Reply-Text: +OK") {
-				fs.Disconnect()
-				return fmt.Errorf("Unexpected filter-events reply received: <%s>", rply)
+		}
+		dispatched = true
+	}
+	// the handlers of the event name, else the ones of the longest matching wildcard, then the ALL ones for every event
+	handleNames := []string{fs.wildcardHandlerKey(eventName), "ALL"}
+	if _, hasHandlers := fs.eventHandlers[eventName]; hasHandlers {
+		handleNames[0] = eventName
+	}
+	var syncHandlers []func(string, int)
+	for _, handleName := range handleNames {
+		if _, hasHandlers := fs.eventHandlers[handleName]; !hasHandlers {
+			continue
+		}
+		if fs.syncDispatch {
+			syncHandlers = append(syncHandlers, fs.eventHandlers[handleName]...)
+		} else {
+			for _, handlerFunc := range fs.eventHandlers[handleName] {
+				fs.handlersWg.Add(1)
+				go func(handler func(string, int)) {
+					defer fs.handlersWg.Done()
+					fs.handleEvent(handler, eventName, event)
+				}(handlerFunc)
 			}
 		}
+		dispatched = true
+	}
+	fs.handlersMux.Unlock()
+	for _, handler := range syncHandlers { // outside the lock so the handlers can register others
+		fs.handlersWg.Add(1)
+		fs.handleEvent(handler, eventName, event)
+		fs.handlersWg.Done()
+	}
+	if evChan != nil { // sent outside the lock since it may block
+		fs.sendEventsChan(evChan, NewEvent(event), dropOnFull, stop)
+	}
+	if !dispatched {
+		fs.logger.Warning(fmt.Sprintf("<FSock> No dispatcher for event: <%+v> with event name: %s", event, eventName))
+		fs.keepUndispatched(event)
 	}
-	return nil
 }
 
-// Dispatch events to handlers in async mode
-func (fs *FSock) dispatchEvent(event string) {
-	eventName := headerVal(event, "Event-Name")
-	if eventName == "BACKGROUND_JOB" { // for bgapi BACKGROUND_JOB
-		go fs.doBackgroundJob(event)
+// sendEventsChan passes the event to the EventsChan, blocking while full unless dropOnFull
+// The blocked send gives up once stop is closed so a stalled consumer does not keep the reading from stopping
+func (fs *FSock) sendEventsChan(evChan chan *Event, ev *Event, dropOnFull bool, stop <-chan struct{}) {
+	select {
+	case evChan <- ev:
+		return
+	default:
+	}
+	if dropOnFull {
+		fs.logger.Warning(fmt.Sprintf("<FSock> Events channel full, dropping event %s", ev.Name))
 		return
 	}
+	select {
+	case evChan <- ev:
+	case <-stop:
+		fs.logger.Warning(fmt.Sprintf("<FSock> Events channel full while stopping, dropping event %s", ev.Name))
+	}
+}
 
-	if eventName == "CUSTOM" {
-		eventSubclass := headerVal(event, "Event-Subclass")
-		if len(eventSubclass) != 0 {
-			eventName += " " + urlDecode(eventSubclass)
-		}
+// handlerKeyMatches checks if the handlers registered under key receive the events with the name, by name, wildcard or ALL
+func handlerKeyMatches(key, eventName string) bool {
+	if key == "ALL" || key == eventName {
+		return true
 	}
+	return strings.HasSuffix(key, "*") && strings.HasPrefix(eventName, key[:len(key)-1])
+}
 
-	for _, handleName := range []string{eventName, "ALL"} {
-		if _, hasHandlers := fs.eventHandlers[handleName]; hasHandlers {
-			// We have handlers, dispatch to all of them
-			for _, handlerFunc := range fs.eventHandlers[handleName] {
-				go handlerFunc(event, fs.connIdx)
-			}
-			return
+// wildcardHandlerKey returns the longest handler key ending in * whose prefix matches the event name
+func (fs *FSock) wildcardHandlerKey(eventName string) (key string) {
+	for hKey := range fs.eventHandlers {
+		if len(hKey) > len(key) && strings.HasSuffix(hKey, "*") &&
+			strings.HasPrefix(eventName, hKey[:len(hKey)-1]) {
+			key = hKey
 		}
 	}
-	fs.logger.Warning(fmt.Sprintf("<FSock> No dispatcher for event: <%+v> with event name: %s", event, eventName))
+	return
+}
+
+// handleEvent runs the handler, recovering from its panics so they do not crash the process
+func (fs *FSock) handleEvent(handler func(string, int), eventName, event string) {
+	defer func() {
+		if r := recover(); r != nil {
+			fs.logger.Err(fmt.Sprintf("<FSock> Handler for event %s panicked: %v\n%s", eventName, r, debug.Stack()))
+		}
+	}()
+	handler(event, fs.connIdx)
 }
 
 // bgapi event lisen fuction
@@ -472,41 +2885,69 @@ func (fs *FSock) doBackgroundJob(event string) { // add mutex protection
 	}
 
 	var out chan string
-	fs.fsMutex.RLock()
+	fs.fsMutex.Lock() // looked up and removed together so disconnected does not close it meanwhile
 	out, has = fs.backgroundChans[jobUUID]
-	fs.fsMutex.RUnlock()
+	delete(fs.backgroundChans, jobUUID)
+	fs.fsMutex.Unlock()
 	if !has {
 		fs.logger.Err(fmt.Sprintf("<FSock> BACKGROUND_JOB with UUID %s lost!", jobUUID))
 		return // not a requested bgapi
 	}
 
-	fs.fsMutex.Lock()
-	delete(fs.backgroundChans, jobUUID)
-	fs.fsMutex.Unlock()
-
 	out <- evMap[EventBodyTag]
 }
 
+// FSHost holds the address and password of one FreeSWITCH node
+type FSHost struct {
+	Address  string
+	Password string
+}
+
 // Instantiates a new FSockPool
 func NewFSockPool(maxFSocks int, fsaddr, fspasswd string, reconnects int, maxWaitConn time.Duration,
 	eventHandlers map[string][]func(string, int), eventFilters map[string][]string,
-	l logger, connIdx int, bgapiSubsc bool) *FSockPool {
+	l Logger, connIdx int, bgapiSubsc bool) *FSockPool {
+	return newFSockPool(maxFSocks, []FSHost{{Address: fsaddr, Password: fspasswd}}, reconnects, maxWaitConn,
+		eventHandlers, eventFilters, l, connIdx, bgapiSubsc)
+}
+
+// NewFSockPoolWithHosts instantiates a new FSockPool creating its sockets round-robin over the hosts
+// At least one host is needed, their addresses being checked upfront
+func NewFSockPoolWithHosts(maxFSocks int, hosts []FSHost, reconnects int, maxWaitConn time.Duration,
+	eventHandlers map[string][]func(string, int), eventFilters map[string][]string,
+	l Logger, connIdx int, bgapiSubsc bool) (*FSockPool, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("No FreeSWITCH hosts for the ConnectionPool")
+	}
+	for _, host := range hosts {
+		if _, _, err := parseFSAddress(host.Address); err != nil {
+			return nil, err
+		}
+	}
+	return newFSockPool(maxFSocks, append([]FSHost{}, hosts...), reconnects, maxWaitConn,
+		eventHandlers, eventFilters, l, connIdx, bgapiSubsc), nil
+}
+
+// newFSockPool instantiates the FSockPool over the hosts, not checked
+func newFSockPool(maxFSocks int, hosts []FSHost, reconnects int, maxWaitConn time.Duration,
+	eventHandlers map[string][]func(string, int), eventFilters map[string][]string,
+	l Logger, connIdx int, bgapiSubsc bool) *FSockPool {
 	if l == nil {
 		l = nopLogger{}
 	}
 	pool := &FSockPool{
 		connIdx:       connIdx,
-		fsAddr:        fsaddr,
-		fsPasswd:      fspasswd,
+		hosts:         hosts,
 		reconnects:    reconnects,
 		maxWaitConn:   maxWaitConn,
 		eventHandlers: eventHandlers,
 		eventFilters:  eventFilters,
-		logger:        l,
+		logWriter:     l,
 		allowedConns:  make(chan struct{}, maxFSocks),
 		fSocks:        make(chan *FSock, maxFSocks),
 		bgapiSubsc:    bgapiSubsc,
 	}
+	pool.logger = dynLogger(pool.logOutput)
 	for i := 0; i < maxFSocks; i++ {
 		pool.allowedConns <- struct{}{} // Empty initiate so we do not need to wait later when we pop
 	}
@@ -516,18 +2957,127 @@ func NewFSockPool(maxFSocks int, fsaddr, fspasswd string, reconnects int, maxWai
 // Connection handler for commands sent to FreeSWITCH
 type FSockPool struct {
 	connIdx       int
-	fsAddr        string
-	fsPasswd      string
+	hosts         []FSHost
+	nextHost      uint32 // Index of the host the next socket will be created on, used round-robin
 	reconnects    int
 	eventHandlers map[string][]func(string, int)
 	eventFilters  map[string][]string
-	logger        logger
+	logger        Logger        // Forwards to logWriter, shared with the sockets of the pool
+	logMux        sync.RWMutex  // Protects logWriter
+	logWriter     Logger        // Replaced with SetLogger
 	allowedConns  chan struct{} // Will be populated with members allowed
 	fSocks        chan *FSock   // Keep here reference towards the list of opened sockets
 	maxWaitConn   time.Duration // Maximum duration to wait for a connection to be returned by Pop
 	bgapiSubsc    bool
+	breakerMux    sync.Mutex
+	breaker       circuitBreaker
+	pinnedMux     sync.Mutex
+	pinned        map[string]*FSock // Sockets dedicated to the calls, see PinFSockForUUID
+	delayMux      sync.RWMutex
+	sleep         func(time.Duration) // Waits between the socket creation attempts, time.Sleep if nil, protected by delayMux
+	maxDelay      time.Duration       // Caps the delays between the attempts, 0 for no cap, protected by delayMux
+}
+
+// Circuit breaker states, as returned by BreakerState
+const (
+	BreakerClosed   = "closed"    // sockets created normally
+	BreakerOpen     = "open"      // socket creation refused until the cooldown passes
+	BreakerHalfOpen = "half-open" // one socket creation allowed to probe FreeSWITCH
+)
+
+// circuitBreaker stops the socket creation after consecutive failures, protected by breakerMux
+type circuitBreaker struct {
+	maxFailures int           // Consecutive failures opening the breaker, 0 to disable it
+	window      time.Duration // The failures need to happen within it, 0 for no limit
+	cooldown    time.Duration // Time the breaker stays open before allowing a probe
+	failures    int
+	firstFail   time.Time
+	openedAt    time.Time
+	open        bool
+	probing     bool // A socket creation is in progress in half-open state
+}
+
+// SetLogger replaces the logger of the pool and of its sockets, nil disabling the logging
+func (fs *FSockPool) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	fs.logMux.Lock()
+	fs.logWriter = l
+	fs.logMux.Unlock()
+}
+
+// logOutput returns the logger set with SetLogger
+func (fs *FSockPool) logOutput() Logger {
+	fs.logMux.RLock()
+	defer fs.logMux.RUnlock()
+	return fs.logWriter
+}
+
+// SetCircuitBreaker refuses for cooldown the socket creation after maxFailures consecutive failures within window
+// PopFSock returns ErrCircuitOpen instead of dialing meanwhile, maxFailures 0 disables the breaker
+func (fs *FSockPool) SetCircuitBreaker(maxFailures int, window, cooldown time.Duration) {
+	fs.breakerMux.Lock()
+	fs.breaker = circuitBreaker{maxFailures: maxFailures, window: window, cooldown: cooldown}
+	fs.breakerMux.Unlock()
+}
+
+// BreakerState returns the state of the circuit breaker
+func (fs *FSockPool) BreakerState() string {
+	fs.breakerMux.Lock()
+	defer fs.breakerMux.Unlock()
+	switch {
+	case !fs.breaker.open:
+		return BreakerClosed
+	case fs.breaker.probing || time.Since(fs.breaker.openedAt) >= fs.breaker.cooldown:
+		return BreakerHalfOpen
+	default:
+		return BreakerOpen
+	}
+}
+
+// breakerAllows checks if a socket can be created, marking the probe in half-open state
+func (fs *FSockPool) breakerAllows() bool {
+	fs.breakerMux.Lock()
+	defer fs.breakerMux.Unlock()
+	if !fs.breaker.open {
+		return true
+	}
+	if fs.breaker.probing || time.Since(fs.breaker.openedAt) < fs.breaker.cooldown {
+		return false
+	}
+	fs.breaker.probing = true
+	return true
+}
+
+// breakerResult records the outcome of a socket creation
+func (fs *FSockPool) breakerResult(err error) {
+	fs.breakerMux.Lock()
+	defer fs.breakerMux.Unlock()
+	if fs.breaker.maxFailures == 0 {
+		return
+	}
+	fs.breaker.probing = false
+	if err == nil {
+		fs.breaker.failures, fs.breaker.open = 0, false
+		return
+	}
+	now := time.Now()
+	if fs.breaker.failures == 0 ||
+		(fs.breaker.window != 0 && now.Sub(fs.breaker.firstFail) > fs.breaker.window) {
+		fs.breaker.failures, fs.breaker.firstFail = 0, now
+	}
+	fs.breaker.failures++
+	if fs.breaker.open || fs.breaker.failures >= fs.breaker.maxFailures {
+		if !fs.breaker.open {
+			fs.logger.Warning(fmt.Sprintf("<FSock> Opening the circuit breaker after %d consecutive connection failures", fs.breaker.failures))
+		}
+		fs.breaker.open, fs.breaker.openedAt = true, now
+	}
 }
 
+// PopFSock returns an idle socket or creates a new one if allowed
+// The connection slot is given back when the creation fails, including when refused by the circuit breaker
 func (fs *FSockPool) PopFSock() (fsock *FSock, err error) {
 	if fs == nil {
 		return nil, errors.New("Unconfigured ConnectionPool")
@@ -543,19 +3093,181 @@ func (fs *FSockPool) PopFSock() (fsock *FSock, err error) {
 		return
 	case <-fs.allowedConns:
 		tm.Stop()
-		return NewFSock(fs.fsAddr, fs.fsPasswd, fs.reconnects, fs.eventHandlers, fs.eventFilters, fs.logger, fs.connIdx, fs.bgapiSubsc)
+		if fsock, err = fs.createFSock(); err != nil {
+			fs.giveBackConn()
+		}
+		return
 	case <-tm.C:
 		return nil, ErrConnectionPoolTimeout
 	}
 }
 
+// Do calls fn with a socket from the pool, pushing it back once fn returns, even if fn panics
+func (fs *FSockPool) Do(fn func(*FSock) error) (err error) {
+	var fsk *FSock
+	if fsk, err = fs.PopFSock(); err != nil {
+		return
+	}
+	defer fs.PushFSock(fsk)
+	return fn(fsk)
+}
+
+// SendApiCmd sends the API command on a socket from the pool and returns its reply
+func (fs *FSockPool) SendApiCmd(cmdStr string) (rply string, err error) {
+	err = fs.Do(func(fsk *FSock) (err error) {
+		rply, err = fsk.SendApiCmd(cmdStr)
+		return
+	})
+	return
+}
+
+// PinFSockForUUID dedicates a socket from the pool to the call with the uuid, returning the same socket until UnpinFSock
+// The call-scoped work, like the filters or the myevents subscriptions, needs it since PopFSock can return any socket
+func (fs *FSockPool) PinFSockForUUID(uuid string) (fsk *FSock, err error) {
+	fs.pinnedMux.Lock()
+	fsk = fs.pinned[uuid]
+	fs.pinnedMux.Unlock()
+	if fsk != nil {
+		return
+	}
+	if fsk, err = fs.PopFSock(); err != nil {
+		return
+	}
+	fs.pinnedMux.Lock()
+	defer fs.pinnedMux.Unlock()
+	if pinned, has := fs.pinned[uuid]; has { // pinned meanwhile by a concurrent call
+		fs.PushFSock(fsk)
+		return pinned, nil
+	}
+	if fs.pinned == nil {
+		fs.pinned = make(map[string]*FSock)
+	}
+	fs.pinned[uuid] = fsk
+	return
+}
+
+// UnpinFSock gives back to the pool the socket pinned for the uuid, once the call ended
+func (fs *FSockPool) UnpinFSock(uuid string) {
+	fs.pinnedMux.Lock()
+	fsk, has := fs.pinned[uuid]
+	delete(fs.pinned, uuid)
+	fs.pinnedMux.Unlock()
+	if has {
+		fs.PushFSock(fsk)
+	}
+}
+
+// SetSleepFunc replaces time.Sleep between the WarmUp attempts and the reconnect attempts of the new sockets
+// nil restores time.Sleep
+func (fs *FSockPool) SetSleepFunc(sleep func(time.Duration)) {
+	fs.delayMux.Lock()
+	fs.sleep = sleep
+	fs.delayMux.Unlock()
+}
+
+// SetMaxReconnectDelay caps the Fibonacci delays of WarmUp and of the new sockets, 0 for no cap
+func (fs *FSockPool) SetMaxReconnectDelay(maxDelay time.Duration) {
+	fs.delayMux.Lock()
+	fs.maxDelay = maxDelay
+	fs.delayMux.Unlock()
+}
+
+// delays returns the sleep function and the delay cap
+func (fs *FSockPool) delays() (func(time.Duration), time.Duration) {
+	fs.delayMux.RLock()
+	defer fs.delayMux.RUnlock()
+	return fs.sleep, fs.maxDelay
+}
+
+// sleepFor waits for d using the function set with SetSleepFunc if any, returning early once ctx is done
+func (fs *FSockPool) sleepFor(ctx context.Context, d time.Duration) {
+	if sleep, _ := fs.delays(); sleep != nil {
+		sleep(d)
+		return
+	}
+	tm := time.NewTimer(d)
+	defer tm.Stop()
+	select {
+	case <-tm.C:
+	case <-ctx.Done():
+	}
+}
+
+// WarmUp creates in background up to minIdle sockets so they are ready on first PopFSock
+// Failures are logged and the socket creation retried, see WarmUpCtx to stop the retries
+func (fs *FSockPool) WarmUp(minIdle int) {
+	fs.WarmUpCtx(context.Background(), minIdle)
+}
+
+// WarmUpCtx is WarmUp retrying until ctx is done, the sockets not created by then giving back their slots
+func (fs *FSockPool) WarmUpCtx(ctx context.Context, minIdle int) {
+	for i := 0; i < minIdle; i++ {
+		select {
+		case <-fs.allowedConns:
+		default: // pool full
+			return
+		}
+		go fs.warmUpConn(ctx)
+	}
+}
+
+// warmUpConn creates one socket for WarmUpCtx, waiting the capped Fibonacci delays between the attempts
+func (fs *FSockPool) warmUpConn(ctx context.Context) {
+	delayFunc := DelayFunc()
+	for {
+		if ctx.Err() != nil {
+			fs.giveBackConn()
+			return
+		}
+		fsk, err := fs.createFSock()
+		if err == nil {
+			fs.fSocks <- fsk
+			return
+		}
+		fs.logger.Err(fmt.Sprintf("<FSock> Cannot warm up connection pool, received: %s", err.Error()))
+		_, maxDelay := fs.delays()
+		fs.sleepFor(ctx, cappedDelay(delayFunc, maxDelay))
+	}
+}
+
+// createFSock creates a new socket unless the circuit breaker refuses it
+func (fs *FSockPool) createFSock() (fsk *FSock, err error) {
+	if !fs.breakerAllows() {
+		return nil, ErrCircuitOpen
+	}
+	fsk, err = fs.newFSock()
+	fs.breakerResult(err)
+	return
+}
+
+// newFSock creates a new socket on the next host in the round-robin
+func (fs *FSockPool) newFSock() (fsk *FSock, err error) {
+	host := fs.hosts[int(atomic.AddUint32(&fs.nextHost, 1)-1)%len(fs.hosts)]
+	if fsk, err = NewFSock(host.Address, host.Password, fs.reconnects, fs.eventHandlers, fs.eventFilters, fs.logger, fs.connIdx, fs.bgapiSubsc); err != nil {
+		return
+	}
+	sleep, maxDelay := fs.delays()
+	fsk.SetSleepFunc(sleep)
+	fsk.SetMaxReconnectDelay(maxDelay)
+	return
+}
+
 func (fs *FSockPool) PushFSock(fsk *FSock) {
 	if fs == nil { // Did not initialize the pool
 		return
 	}
 	if fsk == nil || !fsk.Connected() {
-		fs.allowedConns <- struct{}{}
+		fs.giveBackConn()
 		return
 	}
 	fs.fSocks <- fsk
 }
+
+// giveBackConn allows the creation of another socket, ignoring the slots given back twice
+// like by the callers still pushing nil after PopFSock errors
+func (fs *FSockPool) giveBackConn() {
+	select {
+	case fs.allowedConns <- struct{}{}:
+	default: // all the slots free already
+	}
+}
@@ -152,7 +152,7 @@ func TestFSockNewFSockNilLogger(t *testing.T) {
 	fpaswd := "pw"
 	noreconnects := 5
 	conID := 0
-	var l logger
+	var l Logger
 	evFilters := make(map[string][]string)
 	evHandlers := make(map[string][]func(string, int))
 
@@ -177,7 +177,6 @@ func TestFSockconnect(t *testing.T) {
 		eventHandlers:   make(map[string][]func(string, int)),
 		eventFilters:    make(map[string][]string),
 		backgroundChans: make(map[string]chan string),
-		cmdChan:         make(chan string),
 		reconnects:      -1,
 		delayFunc:       fib(),
 		logger:          nopLogger{},
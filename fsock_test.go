@@ -10,15 +10,21 @@ package fsock
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -115,7 +121,7 @@ func TestReadEvents(t *testing.T) {
 		"CHANNEL_UNPARK":           {evfunc},
 		"CHANNEL_DESTROY":          {evfunc},
 	}
-	go fs.readEvents()
+	go fs.readEvents(fs.stopReadEvents, fs.errReadEvents)
 	w.Write(data)
 	time.Sleep(50 * time.Millisecond)
 	funcMutex.RLock()
@@ -315,7 +321,7 @@ func TestFSockAuthFailRead(t *testing.T) {
 		logger:  new(nopLogger),
 		conn:    new(connMock3),
 	}
-	expected := io.EOF
+	expected := ErrConnectionClosed
 	err := fs.auth()
 
 	if err == nil || err != expected {
@@ -381,7 +387,7 @@ func TestFSockReadEvents(t *testing.T) {
 		errReadEvents:  make(chan error, 1),
 	}
 
-	fs.errReadEvents <- io.EOF
+	fs.errReadEvents <- ErrConnectionClosed
 
 	expected := "Not connected to FreeSWITCH"
 	err := fs.ReadEvents()
@@ -391,6 +397,74 @@ func TestFSockReadEvents(t *testing.T) {
 	}
 }
 
+func TestFSockReadErrors(t *testing.T) {
+	readErr := errors.New("connection reset by peer")
+	for _, tc := range []struct {
+		rdr    io.Reader
+		expErr error
+		expLog string
+	}{
+		{rdr: bytes.NewBufferString(""), expErr: ErrConnectionClosed, expLog: "info: <FSock> Connection closed by FreeSWITCH"},
+		{rdr: iotest.ErrReader(readErr), expErr: readErr, expLog: "error: <FSock> Error reading headers: <connection reset by peer>"},
+	} {
+		l := new(logRecorder)
+		fs := &FSock{fsMutex: new(sync.RWMutex), logger: l, conn: new(connMock3), buffer: bufio.NewReader(tc.rdr)}
+		if _, err := fs.readHeaders(); err != tc.expErr {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", tc.expErr, err)
+		}
+		if msgs := l.Msgs(); len(msgs) == 0 || msgs[0] != tc.expLog {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", tc.expLog, msgs)
+		}
+		if fs.Connected() {
+			t.Error("expected disconnect")
+		}
+	}
+
+	l := new(logRecorder)
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: l, buffer: bufio.NewReader(io.MultiReader(bytes.NewBufferString("+O"), iotest.ErrReader(readErr)))}
+	if _, err := fs.readBody(4); err != readErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", readErr, err)
+	}
+	if exp := []string{"error: <FSock> Error reading message body: <connection reset by peer>"}; !reflect.DeepEqual(exp, l.Msgs()) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, l.Msgs())
+	}
+}
+
+func TestFSockReadEventsReconnectsOnReadError(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 1)
+	go func() { errChan <- fs.ReadEvents() }()
+	fs.Disconnect() // the reader fails with use of closed network connection
+	for i := 0; mFS.Accepted() != 2; i++ {
+		if i == 100 {
+			t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 2, mFS.Accepted())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-errChan:
+		t.Fatalf("ReadEvents returned: %v", err)
+	default:
+	}
+	fs.Close()
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadEvents not returning after Close")
+	}
+}
+
 func TestFSockReadBody(t *testing.T) {
 	fs := &FSock{
 		fsMutex: &sync.RWMutex{},
@@ -399,8 +473,8 @@ func TestFSockReadBody(t *testing.T) {
 	}
 	rply, err := fs.readBody(2)
 
-	if err == nil || err != io.EOF {
-		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", io.EOF, err)
+	if err == nil || err != ErrConnectionClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConnectionClosed, err)
 	}
 
 	if rply != "" {
@@ -408,6 +482,50 @@ func TestFSockReadBody(t *testing.T) {
 	}
 }
 
+func TestFSockReadBodyReusedBuffer(t *testing.T) {
+	sizes := []int{5, 0, 300, 12, maxBodyBufSize + 10, 7}
+	var input []byte
+	for i, size := range sizes {
+		for j := 0; j < size; j++ {
+			input = append(input, byte(i*31+j))
+		}
+	}
+	fs := &FSock{
+		fsMutex: &sync.RWMutex{},
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(bytes.NewReader(input)),
+	}
+	var bodies []string
+	for _, size := range sizes {
+		body, err := fs.readBody(size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies = append(bodies, body)
+	}
+	for i, size := range sizes { // the returned bodies are not changed by the next reads
+		expected := string(input[:size])
+		input = input[size:]
+		if bodies[i] != expected {
+			t.Errorf("body %d of %d bytes differs", i, size)
+		}
+	}
+	if cap(fs.bodyBuf) > maxBodyBufSize {
+		t.Errorf("buffer of %d bytes kept", cap(fs.bodyBuf))
+	}
+}
+
+func TestFSockReadBodyUnexpectedEOF(t *testing.T) {
+	fs := &FSock{
+		fsMutex: &sync.RWMutex{},
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(bytes.NewBufferString("+OK")),
+	}
+	if _, err := fs.readBody(5); err != io.ErrUnexpectedEOF {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", io.ErrUnexpectedEOF, err)
+	}
+}
+
 func TestFSockSendCmdErrSend(t *testing.T) {
 	fs := &FSock{
 		fsMutex:    &sync.RWMutex{},
@@ -432,12 +550,22 @@ func TestFSockSendCmdErrContains(t *testing.T) {
 		logger:     nopLogger{},
 		reconnects: 2,
 		conn:       &connMock3{},
-		cmdChan:    make(chan string, 1),
 	}
 
-	fs.cmdChan <- "test-ERR"
+	go func() {
+		for {
+			fs.rplyMux.Lock()
+			waiting := len(fs.rplyChans) != 0
+			fs.rplyMux.Unlock()
+			if waiting {
+				fs.deliverReply("-ERR test\n", false)
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
 
-	expected := "test-ERR"
+	expected := "-ERR test"
 	rply, err := fs.sendCmd("test")
 	if err == nil || err.Error() != expected {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, err)
@@ -521,11 +649,12 @@ func TestFSockreadEvent(t *testing.T) {
 func TestFSockreadEventsStopRead(t *testing.T) {
 	// nothing to check only for coverage
 	fs := &FSock{
+		fsMutex:        new(sync.RWMutex),
 		stopReadEvents: make(chan struct{}, 1),
 	}
 
 	close(fs.stopReadEvents)
-	fs.readEvents()
+	fs.readEvents(fs.stopReadEvents, fs.errReadEvents)
 }
 
 func TestFSockeventsPlainErrSend(t *testing.T) {
@@ -553,7 +682,7 @@ func TestFSockeventsPlainErrRead(t *testing.T) {
 	}
 	events := []string{"ALL"}
 
-	expected := io.EOF
+	expected := ErrConnectionClosed
 	err := fs.eventsPlain(events, true)
 
 	if err == nil || err != expected {
@@ -608,7 +737,7 @@ func TestFSockfilterEventsErrRead(t *testing.T) {
 		"Event-Name": nil,
 	}
 
-	expected := io.EOF
+	expected := ErrConnectionClosed
 	err := fs.filterEvents(filters, true)
 
 	if err == nil || err != expected {
@@ -765,13 +894,12 @@ func TestFSockNewFSockPool(t *testing.T) {
 
 	fspool := &FSockPool{
 		connIdx:       connIdx,
-		fsAddr:        fsaddr,
-		fsPasswd:      fspw,
+		hosts:         []FSHost{{Address: fsaddr, Password: fspw}},
 		reconnects:    reconns,
 		maxWaitConn:   maxWait,
 		eventHandlers: evHandlers,
 		eventFilters:  evFilters,
-		logger:        nopLogger{},
+		logWriter:     nopLogger{},
 		allowedConns:  nil,
 		fSocks:        nil,
 		bgapiSubsc:    true,
@@ -779,6 +907,10 @@ func TestFSockNewFSockPool(t *testing.T) {
 	fsnew := NewFSockPool(maxFSocks, fsaddr, fspw, reconns, maxWait, evHandlers, evFilters, nil, connIdx, true)
 	fsnew.allowedConns = nil
 	fsnew.fSocks = nil
+	if _, isDyn := fsnew.logger.(dynLogger); !isDyn {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "dynLogger", fsnew.logger)
+	}
+	fsnew.logger = nil // functions are not comparable
 
 	if !reflect.DeepEqual(fspool, fsnew) {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", fspool, fsnew)
@@ -881,20 +1013,19 @@ func TestFSockPopFSock4(t *testing.T) {
 
 func TestFSockPopFSock5(t *testing.T) {
 	fs := &FSockPool{
-		fsAddr:        "testAddr",
-		fsPasswd:      "testPw",
+		hosts:         []FSHost{{Address: "test Addr", Password: "testPw"}},
 		reconnects:    2,
 		eventHandlers: make(map[string][]func(string, int)),
 		eventFilters:  make(map[string][]string),
 		logger:        nopLogger{},
 		connIdx:       0,
 		fSocks:        make(chan *FSock, 1),
-		allowedConns:  make(chan struct{}),
+		allowedConns:  make(chan struct{}, 1),
 		maxWaitConn:   20 * time.Millisecond,
 	}
 
-	expected := "dial tcp: address testAddr: missing port in address"
-	close(fs.allowedConns)
+	expected := "Invalid FreeSWITCH address <test Addr>: invalid host <test Addr>"
+	fs.allowedConns <- struct{}{}
 	fsock, err := fs.PopFSock()
 
 	if err.Error() != expected {
@@ -902,4 +1033,4042 @@ func TestFSockPopFSock5(t *testing.T) {
 	} else if fsock != nil {
 		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, fsock)
 	}
+	if free := len(fs.allowedConns); free != 1 { // given back by the failed creation
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, free)
+	}
+}
+
+// newPipeFSock returns a FSock reading events over an in-memory connection together with the FreeSWITCH side of it
+func newPipeFSock() (fs *FSock, fsConn net.Conn) {
+	clntConn, fsConn := net.Pipe()
+	fs = &FSock{
+		fsMutex:         new(sync.RWMutex),
+		conn:            clntConn,
+		buffer:          bufio.NewReader(clntConn),
+		eventHandlers:   make(map[string][]func(string, int)),
+		eventFilters:    make(map[string][]string),
+		backgroundChans: make(map[string]chan string),
+		delayFunc:       DelayFunc(),
+		logger:          nopLogger{},
+		stopReadEvents:  make(chan struct{}),
+		errReadEvents:   make(chan error, 1),
+	}
+	go fs.readEvents(fs.stopReadEvents, fs.errReadEvents)
+	return
+}
+
+// readMockCmd reads one command, as received by FreeSWITCH, from the buffer
+func readMockCmd(rdr *bufio.Reader) (cmd string, err error) {
+	var line string
+	for {
+		if line, err = rdr.ReadString('\n'); err != nil {
+			return
+		}
+		if line == "\n" {
+			return
+		}
+		cmd += line
+	}
+}
+
+func TestFSockSendMsgCmdCtxTimeout(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	rdr := bufio.NewReader(fsConn)
+	cmdargs := map[string]string{"call-command": "hangup"}
+
+	errChan := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go func() { errChan <- fs.SendMsgCmdCtx(ctx, "uuid1", cmdargs) }()
+	if cmd, err := readMockCmd(rdr); err != nil {
+		t.Fatal(err)
+	} else if exp := "sendmsg uuid1\ncall-command: hangup\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	// withhold the reply until the context expires
+	if err := <-errChan; err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	if _, err := fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: -ERR late reply\n\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the late reply must not be received by the next command
+	go func() { errChan <- fs.SendMsgCmd("uuid2", cmdargs) }()
+	if _, err := readMockCmd(rdr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the reply")
+	}
+}
+
+func TestFSockReadEventsDisconnectNotice(t *testing.T) {
+	l := &loggerMock{}
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.logger = l
+	fs.connIdx = 3
+	disconnected := make(chan int, 1)
+	fs.SetOnDisconnect(func(connIdx int) { disconnected <- connIdx })
+
+	notice := "Disconnected, goodbye.\nSee you at ClueCon! http://www.cluecon.com/\n"
+	if _, err := fsConn.Write([]byte(fmt.Sprintf("Content-Type: text/disconnect-notice\nContent-Length: %d\n\n%s", len(notice), notice))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case connIdx := <-disconnected:
+		if connIdx != 3 {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, connIdx)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnect callback not called")
+	}
+	if err := <-fs.errReadEvents; err != ErrConnectionClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConnectionClosed, err)
+	}
+	if fs.Connected() {
+		t.Error("expected the socket to be disconnected")
+	}
+	if l.msgType == "warning" {
+		t.Errorf("unexpected warning: %s", l.msg)
+	}
+}
+
+func TestFSockSendApiCmdf(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		cmd, err := readMockCmd(rdr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if exp := "api uuid_kill 3d9bcd1f NORMAL_CLEARING\n"; cmd != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+		}
+		fsConn.Write([]byte("Content-Type: api/response\nContent-Length: 4\n\n+OK\n"))
+	}()
+	if rply, err := fs.SendApiCmdf("uuid_kill %s %s", "3d9bcd1f", "NORMAL_CLEARING"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+	}
+}
+
+func TestFSockMaxPendingCmds(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.SetMaxPendingCmds(2)
+	rdr := bufio.NewReader(fsConn)
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := fs.SendApiCmd("status")
+			errs <- err
+		}()
+		if _, err := readMockCmd(rdr); err != nil { // sent, waiting for the reply
+			t.Fatal(err)
+		}
+	}
+	if _, err := fs.SendApiCmd("status"); err != ErrTooManyCommands {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrTooManyCommands, err)
+	}
+	for i := 0; i < 2; i++ {
+		fsConn.Write([]byte("Content-Type: api/response\nContent-Length: 4\n\n+OK\n"))
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	go func() { // slots released with the replies
+		readMockCmd(rdr)
+		fsConn.Write([]byte("Content-Type: api/response\nContent-Length: 4\n\n+OK\n"))
+	}()
+	if _, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockSendApiCmdWithPriority(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	release := mFS.HoldReply("api status")
+	fs, err := NewFSockFromConfig(Config{Address: mFS.Addr(), Password: "ClueCon", MaxInFlight: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	errs := make(chan error, 4)
+	send := func(cmd string, prio CmdPriority) {
+		_, err := fs.SendApiCmdWithPriority(cmd, prio)
+		errs <- err
+	}
+	waiting := func(n int) { // waits until n commands are queued behind the one waiting for its reply
+		for i := 0; ; i++ {
+			fs.cmdQueue.mux.Lock()
+			inFlight, queued := fs.cmdQueue.inFlight, len(fs.cmdQueue.waiting[CmdPriorityNormal])+len(fs.cmdQueue.waiting[CmdPriorityHigh])
+			fs.cmdQueue.mux.Unlock()
+			if inFlight == 1 && queued == n {
+				return
+			}
+			if i == 1000 {
+				t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", n, queued)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	go send("status", CmdPriorityNormal) // its reply held by FreeSWITCH
+	waiting(0)
+	go send("show channels", CmdPriorityNormal)
+	waiting(1)
+	go send("show calls", CmdPriorityNormal)
+	waiting(2)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	if _, err = fs.SendApiCmdCtx(ctx, "show registrations"); err != context.DeadlineExceeded { // gives up its turn
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	cancel()
+	go send("uuid_kill 3d9bcd1f", CmdPriorityHigh)
+	waiting(3)
+	release()
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	var cmds []string
+	for _, cmd := range mFS.Cmds() {
+		if strings.HasPrefix(cmd, "api ") {
+			cmds = append(cmds, cmd)
+		}
+	}
+	if exp := []string{"api status\n", "api uuid_kill 3d9bcd1f\n", "api show channels\n", "api show calls\n"}; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmds)
+	}
+}
+
+func TestFSockSendApiCmdInterleavedCmdReply(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	l := new(logRecorder)
+	fs.logger = l
+	go func() {
+		if _, err := readMockCmd(bufio.NewReader(fsConn)); err != nil {
+			return
+		}
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK stray\n\n"))
+		fsConn.Write([]byte("Content-Type: api/response\nContent-Length: 10\n\nUP 0 years"))
+	}()
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "UP 0 years" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "UP 0 years", rply)
+	}
+	if exp := []string{"warning: <FSock> Received reply with no command waiting: <+OK stray>"}; !reflect.DeepEqual(exp, l.Msgs()) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, l.Msgs())
+	}
+}
+
+func TestFSockSendMsgCmdReplyRouting(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	order := make(chan string, 2)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for i := 0; i < 2; i++ { // both sent before any reply
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			order <- strings.TrimPrefix(strings.SplitN(cmd, "\n", 2)[0], "sendmsg ")
+		}
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: -ERR invalid session id [second]\n\n"))
+	}()
+	errs := make(map[string]chan error)
+	for _, uuid := range []string{"uuid-1", "uuid-2"} {
+		errs[uuid] = make(chan error, 1)
+		go func(uuid string, errChan chan error) {
+			errChan <- fs.SendMsgCmd(uuid, map[string]string{"call-command": "hangup"})
+		}(uuid, errs[uuid])
+	}
+	first, second := <-order, <-order
+	if err := <-errs[first]; err != nil {
+		t.Errorf("unexpected error for the first command on <%s>: %v", first, err)
+	}
+	if err := <-errs[second]; err == nil || !strings.Contains(err.Error(), "[second]") {
+		t.Errorf("expected the second reply for <%s>, received: %v", second, err)
+	}
+}
+
+func TestFSockSendApiCmdErrInBody(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	body := "+OK\n2024-01-01 [ERR] switch_core.c -ERR quoted from the log\n"
+	go func() {
+		if _, err := readMockCmd(bufio.NewReader(fsConn)); err != nil {
+			t.Error(err)
+			return
+		}
+		fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(body), body)
+	}()
+	if rply, err := fs.SendApiCmd("log_tail"); err != nil {
+		t.Error(err)
+	} else if rply != body {
+		t.Errorf("\nExpected: %q, \nReceived: %q", body, rply)
+	}
+}
+
+// mockFS is a FreeSWITCH event socket authenticating the connections and replying +OK to all commands
+type mockFS struct {
+	listener net.Listener
+	passwd   string
+	mux      sync.Mutex
+	accepted int
+	cmds     []string // commands received, over all connections
+	remotes  []string // remote addresses of the accepted connections
+	greetDly time.Duration
+	greeting string // sent instead of the default auth/request if not empty
+	rplys    map[string]string
+	holds    map[string]chan struct{} // replies of the commands held until the channel is closed
+}
+
+func newMockFS(passwd string) (m *mockFS, err error) {
+	return newMockFSOn("127.0.0.1:0", passwd)
+}
+
+func newMockFSOn(addr, passwd string) (m *mockFS, err error) {
+	m = &mockFS{passwd: passwd}
+	if m.listener, err = net.Listen("tcp", addr); err != nil {
+		return nil, err
+	}
+	go m.serve()
+	return
+}
+
+func (m *mockFS) Addr() string {
+	return m.listener.Addr().String()
+}
+
+func (m *mockFS) Close() error {
+	return m.listener.Close()
+}
+
+func (m *mockFS) SetPasswd(passwd string) {
+	m.mux.Lock()
+	m.passwd = passwd
+	m.mux.Unlock()
+}
+
+// SetGreetingDelay delays sending the auth challenge on the new connections
+func (m *mockFS) SetGreetingDelay(dly time.Duration) {
+	m.mux.Lock()
+	m.greetDly = dly
+	m.mux.Unlock()
+}
+
+// SetGreeting replaces the auth challenge sent on the new connections
+func (m *mockFS) SetGreeting(greeting string) {
+	m.mux.Lock()
+	m.greeting = greeting
+	m.mux.Unlock()
+}
+
+// SetReply replaces the reply written as is for the command, without the terminating empty line
+func (m *mockFS) SetReply(cmd, rply string) {
+	m.mux.Lock()
+	if m.rplys == nil {
+		m.rplys = make(map[string]string)
+	}
+	m.rplys[cmd] = rply
+	m.mux.Unlock()
+}
+
+// HoldReply delays the reply of the command, and so the reading of the next commands, until release is called
+func (m *mockFS) HoldReply(cmd string) (release func()) {
+	hold := make(chan struct{})
+	m.mux.Lock()
+	if m.holds == nil {
+		m.holds = make(map[string]chan struct{})
+	}
+	m.holds[cmd] = hold
+	m.mux.Unlock()
+	return func() { close(hold) }
+}
+
+func (m *mockFS) Accepted() int {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.accepted
+}
+
+func (m *mockFS) Remotes() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]string{}, m.remotes...)
+}
+
+func (m *mockFS) Cmds() []string {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return append([]string{}, m.cmds...)
+}
+
+func (m *mockFS) serve() {
+	for {
+		conn, err := m.listener.Accept()
+		if err != nil {
+			return
+		}
+		m.mux.Lock()
+		m.accepted++
+		m.remotes = append(m.remotes, conn.RemoteAddr().String())
+		m.mux.Unlock()
+		go m.handle(conn)
+	}
+}
+
+func (m *mockFS) handle(conn net.Conn) {
+	defer conn.Close()
+	m.mux.Lock()
+	greetDly, greeting := m.greetDly, m.greeting
+	m.mux.Unlock()
+	time.Sleep(greetDly)
+	if greeting == "" {
+		greeting = "Content-Type: auth/request\n\n"
+	}
+	if _, err := conn.Write([]byte(greeting)); err != nil {
+		return
+	}
+	rdr := bufio.NewReader(conn)
+	for {
+		cmd, err := readMockCmd(rdr)
+		if err != nil {
+			return
+		}
+		m.mux.Lock()
+		m.cmds = append(m.cmds, cmd)
+		passwd := m.passwd
+		rply, custom := m.rplys[strings.TrimSuffix(cmd, "\n")]
+		hold := m.holds[strings.TrimSuffix(cmd, "\n")]
+		m.mux.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		switch {
+		case custom:
+		case cmd == "auth "+passwd+"\n":
+			rply = "Content-Type: command/reply\nReply-Text: +OK accepted\n\n"
+		case strings.HasPrefix(cmd, "auth "):
+			rply = "Content-Type: command/reply\nReply-Text: -ERR invalid\n\n"
+		case strings.HasPrefix(cmd, "api "):
+			rply = "Content-Type: api/response\nContent-Length: 4\n\n+OK\n"
+		default:
+			rply = "Content-Type: command/reply\nReply-Text: +OK\n\n"
+		}
+		if _, err = conn.Write([]byte(rply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestFSockReconnectMidFrame(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	mFS.SetReply("api partial", "Content-Type: api/response\nContent-Length: 64\n\n+OK stale") // the rest never arrives
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1, nil, nil, nopLogger{}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err = fs.SendApiCmdCtx(ctx, "partial"); err != context.DeadlineExceeded {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	fs.Disconnect() // lost with the reader in the middle of the body
+	for i := 0; i < 3; i++ {
+		if rply, err := fs.SendApiCmd("status"); err != nil {
+			t.Fatal(err)
+		} else if rply != "+OK\n" {
+			t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+		}
+	}
+	if !fs.Connected() {
+		t.Error("new connection closed by the reader of the old one")
+	}
+	if mFS.Accepted() != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, mFS.Accepted())
+	}
+}
+
+func TestFSockTestConnection(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = TestConnection(ctx, mFS.Addr(), "ClueCon", nil); err != nil {
+		t.Error(err)
+	}
+	if err = TestConnection(ctx, mFS.Addr(), "wrong", nil); !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrAuthRejected, err)
+	} else if exp := "Authentication rejected: <-ERR invalid>"; err.Error() != exp {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, err)
+	}
+	if exp := []string{"auth ClueCon\n", "auth wrong\n"}; !reflect.DeepEqual(exp, mFS.Cmds()) { // no event subscriptions
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, mFS.Cmds())
+	}
+	mFS.Close()
+	if err = TestConnection(ctx, mFS.Addr(), "ClueCon", nil); err == nil {
+		t.Error("expected connection error")
+	}
+}
+
+func TestFSockConnectLateGreeting(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	mFS.SetGreetingDelay(120 * time.Millisecond)
+	defer func(tmout time.Duration, retries int) {
+		GreetingTimeout, GreetingRetries = tmout, retries
+	}(GreetingTimeout, GreetingRetries)
+	GreetingTimeout, GreetingRetries = 50*time.Millisecond, 5
+	l := new(logRecorder)
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, nil, nil, l, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if !fs.Connected() {
+		t.Error("expected connected")
+	}
+	if accepted := mFS.Accepted(); accepted != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, accepted)
+	}
+	if msgs := l.Msgs(); len(msgs) < 2 || msgs[1] != "warning: <FSock> Timeout reading the auth challenge, retry 1 of 5" {
+		t.Errorf("unexpected logs: %q", msgs)
+	}
+
+	GreetingRetries = 0
+	if err = fs.Reconnect(); err == nil {
+		t.Error("expected error without retries")
+	}
+}
+
+func TestFSockPing(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = fs.Ping(ctx); err != nil {
+		t.Error(err)
+	}
+	if cmds := mFS.Cmds(); cmds[len(cmds)-1] != "api status\n" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "api status\n", cmds[len(cmds)-1])
+	}
+}
+
+func TestFSockPingSilent(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	go io.Copy(ioutil.Discard, fsConn) // reads the commands without replying
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := fs.Ping(ctx); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+}
+
+func TestFSockWaitBgJobLost(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	go func() {
+		if _, err := readMockCmd(bufio.NewReader(fsConn)); err != nil {
+			return
+		}
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+	}()
+	out, err := fs.SendBgapiCmd("originate user/1000 &park")
+	if err != nil {
+		t.Fatal(err)
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := WaitBgJob(context.Background(), out)
+		errChan <- err
+	}()
+	fsConn.Close() // drop the connection before the job finishes
+	select {
+	case err = <-errChan:
+		if err != ErrBgJobLost {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrBgJobLost, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter not unblocked")
+	}
+	fs.fsMutex.RLock()
+	pending := len(fs.backgroundChans)
+	fs.fsMutex.RUnlock()
+	if pending != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, pending)
+	}
+}
+
+func TestFSockWaitBgJob(t *testing.T) {
+	fs := &FSock{
+		fsMutex:         new(sync.RWMutex),
+		logger:          nopLogger{},
+		backgroundChans: make(map[string]chan string),
+	}
+	out := make(chan string)
+	fs.backgroundChans["job1"] = out
+	go fs.doBackgroundJob("Event-Name: BACKGROUND_JOB\nJob-UUID: job1\n\n+OK done")
+	if rply, err := WaitBgJob(context.Background(), out); err != nil {
+		t.Error(err)
+	} else if rply != "+OK done" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "+OK done", rply)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := WaitBgJob(ctx, make(chan string)); err != context.Canceled {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.Canceled, err)
+	}
+}
+
+func TestFSockBackgroundJobDuringDisconnect(t *testing.T) {
+	fs := &FSock{
+		fsMutex:         new(sync.RWMutex),
+		logger:          nopLogger{},
+		backgroundChans: make(map[string]chan string),
+	}
+	for i := 0; i < 500; i++ { // either the job delivers its output or the disconnect closes the channel, never both
+		out := make(chan string)
+		fs.fsMutex.Lock()
+		fs.backgroundChans["job1"] = out
+		fs.fsMutex.Unlock()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			fs.doBackgroundJob("Event-Name: BACKGROUND_JOB\nJob-UUID: job1\n\n+OK done")
+		}()
+		go fs.disconnected()
+		if _, err := WaitBgJob(context.Background(), out); err != nil && err != ErrBgJobLost {
+			t.Fatal(err)
+		}
+		<-done
+	}
+}
+
+func TestFSockPoolCircuitBreaker(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	mFS.SetPasswd("other") // the auth fails
+	pool := NewFSockPool(1, mFS.Addr(), "ClueCon", 0, time.Second, nil, nil, nil, 0, false)
+	pool.SetCircuitBreaker(3, time.Minute, 100*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if state := pool.BreakerState(); state != BreakerClosed {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", BreakerClosed, state)
+		}
+		if _, err = pool.PopFSock(); !errors.Is(err, ErrAuthRejected) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrAuthRejected, err)
+		}
+	}
+	if state := pool.BreakerState(); state != BreakerOpen {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", BreakerOpen, state)
+	}
+	if _, err = pool.PopFSock(); err != ErrCircuitOpen {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrCircuitOpen, err)
+	}
+	if free := len(pool.allowedConns); free != 1 { // given back by the failed creations
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, free)
+	}
+	if accepted := mFS.Accepted(); accepted != 3 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, accepted)
+	}
+
+	time.Sleep(100 * time.Millisecond) // cooldown
+	if state := pool.BreakerState(); state != BreakerHalfOpen {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", BreakerHalfOpen, state)
+	}
+	if _, err = pool.PopFSock(); !errors.Is(err, ErrAuthRejected) { // the failed probe opens it again
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrAuthRejected, err)
+	}
+	if state := pool.BreakerState(); state != BreakerOpen {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", BreakerOpen, state)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mFS.SetPasswd("ClueCon")
+	fsk, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsk.Disconnect()
+	if state := pool.BreakerState(); state != BreakerClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", BreakerClosed, state)
+	}
+}
+
+func TestFSockEventNameValidation(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	l := new(logRecorder)
+	fs, err := NewFSockFromConfig(Config{
+		Address:  mFS.Addr(),
+		Password: "ClueCon",
+		EventHandlers: map[string][]func(string, int){
+			"CHANEL_ANSWER":        {func(string, int) {}},
+			"CUSTOM sofia::gatway": {func(string, int) {}},
+		},
+		Logger:             l,
+		ValidateEventNames: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if err = fs.AddEvents("HEARTBEAT", "HEARTBEET"); err != nil {
+		t.Fatal(err)
+	}
+	var warnings []string
+	for _, msg := range l.Msgs() {
+		if strings.HasPrefix(msg, "warning: ") {
+			warnings = append(warnings, msg)
+		}
+	}
+	expected := []string{
+		"warning: <FSock> Subscribing to unknown event name <CHANEL_ANSWER>, check it for typos",
+		"warning: <FSock> Subscribing to unknown event name <HEARTBEET>, check it for typos",
+	}
+	if !reflect.DeepEqual(expected, warnings) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, warnings)
+	}
+	if cmds := mFS.Cmds(); cmds[len(cmds)-1] != "event plain HEARTBEAT HEARTBEET\n" { // still subscribed
+		t.Errorf("\nExpected: %q, \nReceived: %q", "event plain HEARTBEAT HEARTBEET\n", cmds[len(cmds)-1])
+	}
+}
+
+func TestFSockLabels(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	l := new(logRecorder)
+	fs, err := NewFSockFromConfig(Config{
+		Address:  mFS.Addr(),
+		Password: "ClueCon",
+		Logger:   l,
+		Labels:   map[string]string{"role": "edge"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	fs.SetLabel("region", "eu")
+	fs.SetLabel("tmp", "1")
+	fs.SetLabel("tmp", "") // removed
+	expected := map[string]string{"role": "edge", "region": "eu"}
+	stats := fs.Stats()
+	if !reflect.DeepEqual(expected, stats.Labels) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, stats.Labels)
+	}
+	if stats.Address != mFS.Addr() || !stats.Connected || stats.ConnectedSince.IsZero() {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	stats.Labels["role"] = "core" // a copy is returned
+	if labels := fs.Labels(); !reflect.DeepEqual(expected, labels) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, labels)
+	}
+	fs.Disconnect()
+	if msgs := l.Msgs(); !isSliceMember(msgs, "info: <FSock> Disconnecting from FreeSWITCH! [region=eu role=edge]") {
+		t.Errorf("labels missing from the logs: %q", msgs)
+	}
+}
+
+func TestFSockCmdsTerminated(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	l := new(logRecorder)
+	fs, err := NewFSockFromConfig(Config{
+		Address:        mFS.Addr(),
+		Password:       "ClueCon",
+		EventHandlers:  map[string][]func(string, int){"HEARTBEAT": {func(string, int) {}}},
+		EventFilters:   map[string][]string{"Event-Name": {"HEARTBEAT"}},
+		Logger:         l,
+		BgapiSubscribe: true,
+		Trace:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if _, err = fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+	if _, err = fs.SendCmd("noevents"); err != nil {
+		t.Error(err)
+	}
+	if err = fs.SendMsgCmd("3d9bcd1f", map[string]string{"call-command": "hangup"}); err != nil {
+		t.Error(err)
+	}
+	if err = fs.AddEventFilters([]EventFilter{{Header: "Unique-ID", Value: "3d9bcd1f"}}); err != nil {
+		t.Error(err)
+	}
+	var sent []string // all the writes are traced by send
+	for _, msg := range l.Msgs() {
+		if strings.HasPrefix(msg, "debug: <FSock> Sent: <") {
+			sent = append(sent, strings.TrimSuffix(strings.TrimPrefix(msg, "debug: <FSock> Sent: <"), ">"))
+		}
+	}
+	var expected []string
+	for _, cmd := range mFS.Cmds() {
+		if strings.HasPrefix(cmd, "auth ") {
+			cmd = "auth ****\n"
+		}
+		expected = append(expected, cmd+"\n")
+	}
+	if len(expected) != 8 {
+		t.Errorf("unexpected commands: %q", expected)
+	}
+	if !reflect.DeepEqual(expected, sent) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, sent)
+	}
+}
+
+// lingerConn records the linger set on the connection
+type lingerConn struct {
+	net.Conn
+	linger *int
+}
+
+func (lC *lingerConn) SetLinger(sec int) error {
+	lC.linger = &sec
+	return lC.Conn.(*net.TCPConn).SetLinger(sec)
+}
+
+func TestFSockLinger(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	linger := 0
+	fs, err := NewFSockFromConfig(Config{Address: mFS.Addr(), Password: "ClueCon", Linger: &linger})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if fs.linger == nil || *fs.linger != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, fs.linger)
+	}
+	conn, err := net.Dial("tcp", mFS.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	lConn := &lingerConn{Conn: conn}
+	fs.SetLinger(5)
+	fs.applyLinger(lConn)
+	if lConn.linger == nil || *lConn.linger != 5 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 5, lConn.linger)
+	}
+	lConn.linger = nil
+	(&FSock{fsMutex: new(sync.RWMutex)}).applyLinger(lConn) // not configured
+	if lConn.linger != nil {
+		t.Errorf("unexpected linger: %d", *lConn.linger)
+	}
+}
+
+func TestFSockConnectPaddedGreeting(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	mFS.SetGreeting("\r\n\nContent-Type:   auth/request  \r\nContent-Length: 0\r\n\r\n")
+	defer func(tmout time.Duration) { GreetingTimeout = tmout }(GreetingTimeout)
+	for _, GreetingTimeout = range []time.Duration{time.Second, 0} {
+		fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, nil, nil, nil, 0, false)
+		if err != nil {
+			t.Fatalf("greeting timeout %v: %v", GreetingTimeout, err)
+		}
+		if _, err = fs.SendApiCmd("status"); err != nil {
+			t.Error(err)
+		}
+		fs.Disconnect()
+	}
+
+	mFS.SetGreeting("Content-Type: auth/requested\n\n")
+	expErr := "No auth challenge received"
+	if _, err = NewFSock(mFS.Addr(), "ClueCon", 0, nil, nil, nil, 0, false); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockPoolSharedHandlers(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	handlers := map[string][]func(string, int){"HEARTBEAT": {func(string, int) {}}}
+	filters := map[string][]string{"Event-Name": {"HEARTBEAT"}}
+	pool := NewFSockPool(2, mFS.Addr(), "ClueCon", 0, time.Second, handlers, filters, nil, 0, false)
+	fsk1, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsk1.Disconnect()
+	fsk2, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsk2.Disconnect()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() { // the race detector fails the test if the sockets share the maps
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			fsk1.AddEventHandler("HEARTBEAT", func(string, int) {})
+			fsk1.AddEventFilters([]EventFilter{{Header: "Unique-ID", Value: strconv.Itoa(i)}})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			fsk2.dispatchEvent("Event-Name: HEARTBEAT\n")
+			fsk2.AddEventHandler("CHANNEL_ANSWER", func(string, int) {})
+		}
+	}()
+	wg.Wait()
+	if len(handlers) != 1 || len(handlers["HEARTBEAT"]) != 1 || len(filters) != 1 {
+		t.Errorf("the maps given to the pool were changed: %d handlers, %d filters", len(handlers), len(filters))
+	}
+	fsk2.handlersMux.RLock()
+	heartbeats, answers := len(fsk2.eventHandlers["HEARTBEAT"]), len(fsk2.eventHandlers["CHANNEL_ANSWER"])
+	fsk2.handlersMux.RUnlock()
+	if heartbeats != 1 || answers != 50 {
+		t.Errorf("unexpected handlers: %d HEARTBEAT, %d CHANNEL_ANSWER", heartbeats, answers)
+	}
+}
+
+func TestFSockPopFSockMultipleHosts(t *testing.T) {
+	fs1, err := newMockFS("pw1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs1.Close()
+	fs2, err := newMockFS("pw2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs2.Close()
+
+	pool, err := NewFSockPoolWithHosts(4, []FSHost{
+		{Address: fs1.Addr(), Password: "pw1"},
+		{Address: fs2.Addr(), Password: "pw2"},
+	}, 1, time.Second, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		fsk, err := pool.PopFSock()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fsk.Disconnect()
+	}
+	if fs1.Accepted() != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, fs1.Accepted())
+	}
+	if fs2.Accepted() != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, fs2.Accepted())
+	}
+}
+
+func TestFSockNewFSockPoolWithHostsInvalid(t *testing.T) {
+	expErr := "No FreeSWITCH hosts for the ConnectionPool"
+	if _, err := NewFSockPoolWithHosts(1, nil, 1, time.Second, nil, nil, nil, 0, false); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	expErr = "Invalid FreeSWITCH address <udp://127.0.0.1>: unsupported scheme <udp>"
+	if _, err := NewFSockPoolWithHosts(1, []FSHost{{Address: "127.0.0.1"}, {Address: "udp://127.0.0.1"}},
+		1, time.Second, nil, nil, nil, 0, false); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockSendMsgCmdAsync(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	rdr := bufio.NewReader(fsConn)
+	cmdargs := map[string]string{"call-command": "execute"}
+
+	errChan := make(chan error, 1)
+	go func() { errChan <- fs.SendMsgCmdAsync("uuid1", cmdargs) }()
+	if cmd, err := readMockCmd(rdr); err != nil {
+		t.Fatal(err)
+	} else if exp := "sendmsg uuid1\ncall-command: execute\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	select { // no reply sent yet
+	case err := <-errChan:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("SendMsgCmdAsync waited for the reply")
+	}
+
+	go func() { errChan <- fs.SendMsgCmd("uuid2", cmdargs) }()
+	if _, err := readMockCmd(rdr); err != nil {
+		t.Fatal(err)
+	}
+	// the reply of the async command comes first and needs to be discarded
+	if _, err := fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: -ERR async\n\n" +
+		"Content-Type: command/reply\nReply-Text: +OK\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errChan:
+		if err != nil {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the reply")
+	}
+}
+
+func TestFSockNewFSockInvalidAddress(t *testing.T) {
+	expected := "Invalid FreeSWITCH address <127.0.0.1:80:21>: address 127.0.0.1:80:21: too many colons in address"
+	if fs, err := NewFSock("127.0.0.1:80:21", "ClueCon", 0, nil, nil, nil, 0, true); err == nil || err.Error() != expected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, err)
+	} else if fs != nil {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", nil, fs)
+	}
+}
+
+func TestFSockNewFSockHostPort(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if fs.fsnetwork != "tcp" || fs.fsaddress != mFS.Addr() {
+		t.Errorf("\nExpected: <%s %s>, \nReceived: <%s %s>", "tcp", mFS.Addr(), fs.fsnetwork, fs.fsaddress)
+	}
+}
+
+func TestFSockSendApiCmdCached(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	fs.SetApiCache(time.Minute, "status")
+
+	for _, cmd := range []string{"status", "status", "sofia status", "sofia status"} {
+		if rply, err := fs.SendApiCmd(cmd); err != nil {
+			t.Error(err)
+		} else if rply != "+OK\n" {
+			t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+		}
+	}
+	var apiCmds []string
+	for _, cmd := range mFS.Cmds() {
+		if strings.HasPrefix(cmd, "api ") {
+			apiCmds = append(apiCmds, cmd)
+		}
+	}
+	if exp := []string{"api status\n", "api sofia status\n", "api sofia status\n"}; !reflect.DeepEqual(exp, apiCmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, apiCmds)
+	}
+}
+
+func TestFSockReadHeadersCRLF(t *testing.T) {
+	fs := &FSock{
+		fsMutex: new(sync.RWMutex),
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(bytes.NewBufferString("Content-Length: 564\r\nContent-Type: text/event-plain\r\n\r\nEvent-Name: HEARTBEAT")),
+	}
+	exp := "Content-Length: 564\nContent-Type: text/event-plain\n"
+	if h, err := fs.readHeaders(); err != nil {
+		t.Error(err)
+	} else if h != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, h)
+	}
+	if rest, _ := fs.buffer.ReadString(0); rest != "Event-Name: HEARTBEAT" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "Event-Name: HEARTBEAT", rest)
+	}
+}
+
+func TestFSockReadEventCRLFSplit(t *testing.T) {
+	r, w := net.Pipe()
+	defer w.Close()
+	fs := &FSock{
+		fsMutex: new(sync.RWMutex),
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(r),
+	}
+	go func() { // the delimiter arrives split over several segments
+		for _, segment := range []string{"Content-Type: api/response\r", "\nContent-Length: 4\r\n\r", "\n+OK\n"} {
+			w.Write([]byte(segment))
+		}
+	}()
+	hdr, body, err := fs.readEvent()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "Content-Type: api/response\nContent-Length: 4\n"; hdr != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, hdr)
+	}
+	if body != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", body)
+	}
+}
+
+func TestFSockReconnect(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	for i := 0; i < 5; i++ { // advance the backoff as failed reconnects would
+		fs.delayFunc()
+	}
+	fs.fsMutex.RLock()
+	oldConn := fs.conn
+	fs.fsMutex.RUnlock()
+
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	fs.fsMutex.RLock()
+	newConn := fs.conn
+	fs.fsMutex.RUnlock()
+	if newConn == nil || newConn == oldConn {
+		t.Errorf("expected a new connection, received: %+v", newConn)
+	}
+	if _, err = oldConn.Write([]byte("api status\n\n")); err == nil {
+		t.Error("expected the old connection to be closed")
+	}
+	if mFS.Accepted() != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, mFS.Accepted())
+	}
+	var delays []int
+	for i := 0; i < 5; i++ {
+		delays = append(delays, fs.delayFunc())
+	}
+	if exp := []int{1, 1, 2, 3, 5}; !reflect.DeepEqual(exp, delays) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, delays)
+	}
+}
+
+func TestFSockReconnectDuringReadEvents(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 3, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.sleep = func(time.Duration) {}
+	readDone := make(chan error, 1)
+	go func() { readDone <- fs.ReadEvents() }()
+	for i := 0; i < 5; i++ { // the reader fails and reconnects while forced to reconnect
+		fs.Disconnect()
+		if err = fs.Reconnect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fs.Close()
+	select {
+	case <-readDone:
+	case <-time.After(time.Second):
+		t.Fatal("ReadEvents not returning after Close")
+	}
+}
+
+func TestFSockReconnectResubscribesRuntimeHandlers(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if err = fs.AddEventHandler("CHANNEL_ANSWER", func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	cmds := mFS.Cmds()
+	lastAuth := -1
+	for i, cmd := range cmds {
+		if cmd == "auth ClueCon\n" {
+			lastAuth = i
+		}
+	}
+	if lastAuth == -1 || !isSliceMember(cmds[lastAuth:], "event plain CHANNEL_ANSWER\n") {
+		t.Errorf("expected CHANNEL_ANSWER resubscribed after the reconnect, received: %q", cmds)
+	}
+}
+
+func TestFSockReconnectResubscribesWildcardHandlers(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	ev := "Event-Name: CHANNEL_ANSWER\n"
+	mFS.SetReply("api answer", fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)+
+		"Content-Type: api/response\nContent-Length: 4\n\n+OK\n")
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	fs.SetEventReplay(1)
+	received := make(chan string, 2)
+	if err = fs.AddEventHandlerWithReplay("CHANNEL_A*", func(ev string, _ int) { received <- eventName(ev) }); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	cmds := mFS.Cmds()
+	lastAuth := -1
+	for i, cmd := range cmds {
+		if cmd == "auth ClueCon\n" {
+			lastAuth = i
+		}
+	}
+	if exp := "event plain CHANNEL_ANSWER CHANNEL_APPLICATION\n"; lastAuth == -1 || !isSliceMember(cmds[lastAuth:], exp) {
+		t.Errorf("expected %q after the reconnect, received: %q", exp, cmds)
+	}
+	if _, err = fs.SendApiCmd("answer"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evName := <-received:
+		if evName != "CHANNEL_ANSWER" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_ANSWER", evName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("wildcard handler not called after the reconnect")
+	}
+
+	received2 := make(chan string, 1) // the event kept for replay matches the wildcard too
+	if err = fs.AddEventHandlerWithReplay("CHANNEL_*", func(ev string, _ int) { received2 <- eventName(ev) }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case evName := <-received2:
+		if evName != "CHANNEL_ANSWER" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_ANSWER", evName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not replayed to the wildcard handler")
+	}
+}
+
+func TestFSockReadEventsBodyStreamer(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	handled := make(chan string, 2)
+	fs.eventHandlers["HEARTBEAT"] = []func(string, int){func(ev string, _ int) { handled <- ev }}
+	fs.eventHandlers["RE_SCHEDULE"] = []func(string, int){func(ev string, _ int) { handled <- ev }}
+	streamed := make(chan string, 1)
+	fs.SetBodyStreamer(100, func(hdr string, body io.Reader, _ int) {
+		b, err := ioutil.ReadAll(body)
+		if err != nil {
+			t.Error(err)
+		}
+		streamed <- string(b)
+	})
+
+	smallEv := "Event-Name: HEARTBEAT\n\n"
+	if _, err := fsConn.Write([]byte(HEADER + BODY[:564] +
+		fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(smallEv), smallEv))); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-streamed:
+		if body != BODY[:564] {
+			t.Errorf("\nExpected: %q, \nReceived: %q", BODY[:564], body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("large event not streamed")
+	}
+	select {
+	case ev := <-handled:
+		if ev != smallEv {
+			t.Errorf("\nExpected: %q, \nReceived: %q", smallEv, ev)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("small event not dispatched")
+	}
+}
+
+func TestFSockBodyStreamerBackgroundJob(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.SetBodyStreamer(10, func(string, io.Reader, int) { t.Error("BACKGROUND_JOB streamed") })
+	out := make(chan string, 1)
+	fs.fsMutex.Lock()
+	fs.backgroundChans["job1"] = out
+	fs.fsMutex.Unlock()
+	output := strings.Repeat("uuid,direction,created\n", 50)
+	ev := fmt.Sprintf("Event-Name: BACKGROUND_JOB\nJob-UUID: job1\nContent-Length: %d\n\n%s", len(output), output)
+	if _, err := fmt.Fprintf(fsConn, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rply := <-out:
+		if rply != output {
+			t.Errorf("\nExpected: %q, \nReceived: %q", output, rply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("background job output not received")
+	}
+}
+
+func TestFSockLastActivity(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	if lastActivity := fs.LastActivity(); !lastActivity.IsZero() {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", time.Time{}, lastActivity)
+	}
+	before := time.Now()
+	if _, err := fsConn.Write([]byte(HEADER + BODY[:564])); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && fs.LastActivity().IsZero(); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if lastActivity := fs.LastActivity(); lastActivity.Before(before) {
+		t.Errorf("expected last activity after %v, received: %v", before, lastActivity)
+	}
+}
+
+func TestFSockReconnectIfNeededDelays(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsaddr := l.Addr().String()
+	l.Close() // nothing listening so all the reconnects fail
+	var delays []time.Duration
+	fs := &FSock{
+		fsMutex:    new(sync.RWMutex),
+		fsaddress:  fsaddr,
+		logger:     nopLogger{},
+		reconnects: 6,
+		delayFunc:  DelayFunc(),
+		sleep:      func(d time.Duration) { delays = append(delays, d) },
+	}
+	if err = fs.ReconnectIfNeeded(); err == nil {
+		t.Fatal("expected connection error")
+	}
+	if exp := []time.Duration{time.Second, time.Second, 2 * time.Second,
+		3 * time.Second, 5 * time.Second, 8 * time.Second}; !reflect.DeepEqual(exp, delays) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, delays)
+	}
+}
+
+func TestFSockReconnectIfNeededMaxDelay(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsaddr := l.Addr().String()
+	l.Close()
+	var delays []time.Duration
+	fs := &FSock{
+		fsMutex:    new(sync.RWMutex),
+		fsaddress:  fsaddr,
+		logger:     nopLogger{},
+		reconnects: 6,
+		delayFunc:  DelayFunc(),
+	}
+	fs.SetSleepFunc(func(d time.Duration) { delays = append(delays, d) })
+	fs.SetMaxReconnectDelay(3 * time.Second)
+	if err = fs.ReconnectIfNeeded(); err == nil {
+		t.Fatal("expected connection error")
+	}
+	if exp := []time.Duration{time.Second, time.Second, 2 * time.Second,
+		3 * time.Second, 3 * time.Second, 3 * time.Second}; !reflect.DeepEqual(exp, delays) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, delays)
+	}
+}
+
+func TestFSockReconnecting(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsaddr := l.Addr().String()
+	l.Close()
+	var attempts []int
+	fs := &FSock{
+		fsMutex:    new(sync.RWMutex),
+		fsaddress:  fsaddr,
+		logger:     nopLogger{},
+		reconnects: 3,
+		delayFunc:  DelayFunc(),
+	}
+	fs.sleep = func(time.Duration) {
+		if !fs.Reconnecting() {
+			t.Error("expected reconnecting")
+		}
+		attempts = append(attempts, fs.ReconnectAttempt())
+	}
+	if fs.Reconnecting() {
+		t.Error("unexpected reconnecting before")
+	}
+	if err = fs.ReconnectIfNeeded(); err == nil {
+		t.Fatal("expected connection error")
+	}
+	if exp := []int{1, 2, 3}; !reflect.DeepEqual(exp, attempts) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, attempts)
+	}
+	if fs.Reconnecting() || fs.ReconnectAttempt() != 0 {
+		t.Error("unexpected reconnecting after giving up")
+	}
+}
+
+func TestFSockOnReconnectAttempt(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsaddr := l.Addr().String()
+	l.Close()
+	type attempt struct {
+		try    int
+		addr   string
+		failed bool
+	}
+	var attempts []attempt
+	fs, err := NewFSockFromConfig(Config{
+		Address:    fsaddr,
+		Password:   "ClueCon",
+		Reconnects: 3,
+		Lazy:       true,
+		OnReconnectAttempt: func(try int, addr string, err error) {
+			attempts = append(attempts, attempt{try: try, addr: addr, failed: err != nil})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mFS *mockFS
+	fs.sleep = func(time.Duration) { // FreeSWITCH comes up after the first attempt
+		if mFS == nil {
+			if mFS, err = newMockFSOn(fsaddr, "ClueCon"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	defer func() {
+		fs.Close()
+		if mFS != nil {
+			mFS.Close()
+		}
+	}()
+	if err = fs.ReconnectIfNeeded(); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []attempt{{1, fsaddr, true}, {2, fsaddr, false}}; !reflect.DeepEqual(exp, attempts) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, attempts)
+	}
+}
+
+func TestFSockSendApiCmdWithTrace(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	go func() {
+		cmd, err := readMockCmd(bufio.NewReader(fsConn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if exp := "api status\nEvent-UUID: 7f4de4bc-17d7-11ee-be56-0242ac120002\n"; cmd != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+		}
+		fsConn.Write([]byte("Content-Type: api/response\nContent-Length: 4\n\n+OK\n"))
+	}()
+	if rply, err := fs.SendApiCmdWithTrace("status", "7f4de4bc-17d7-11ee-be56-0242ac120002"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+	}
+}
+
+func TestFSockNewFSockLazy(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedAddr := l.Addr().String()
+	l.Close()
+	if fs, err := NewFSockLazy(closedAddr, "ClueCon", 1, nil, nil, nil, 0, true); err != nil {
+		t.Error(err)
+	} else if fs.Connected() {
+		t.Error("expected lazy FSock not to be connected")
+	}
+
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockLazy(mFS.Addr(), "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mFS.Accepted() != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, mFS.Accepted())
+	}
+	// first command connects
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+	}
+	defer fs.Disconnect()
+	if !fs.Connected() {
+		t.Error("expected FSock to be connected")
+	}
+	if mFS.Accepted() != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, mFS.Accepted())
+	}
+}
+
+func TestFSockNewFSockLazyNoReconnects(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockLazy(mFS.Addr(), "ClueCon", 0, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	if accepted := mFS.Accepted(); accepted != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, accepted)
+	}
+	fs.Disconnect() // lost once connected, not reconnected with 0 reconnects
+	if _, err = fs.SendApiCmd("status"); err == nil {
+		t.Error("expected error without reconnects")
+	}
+	if accepted := mFS.Accepted(); accepted != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, accepted)
+	}
+}
+
+func TestFSockAddEventHandlerWithReplay(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.SetEventReplay(2)
+	writeEv := func(evName string, seq int) {
+		ev := fmt.Sprintf("Event-Name: %s\nEvent-Sequence: %d\n\n", evName, seq)
+		if _, err := fsConn.Write([]byte(fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeEv("HEARTBEAT", 1) // out of the replay buffer
+	writeEv("HEARTBEAT", 2)
+	writeEv("RE_SCHEDULE", 3)
+	writeEv("HEARTBEAT", 4)
+	for i := 0; i < 100; i++ {
+		fs.handlersMux.RLock()
+		lastSeq := ""
+		if len(fs.replayEvents) != 0 {
+			lastSeq = headerVal(fs.replayEvents[len(fs.replayEvents)-1].event, "Event-Sequence")
+		}
+		fs.handlersMux.RUnlock()
+		if lastSeq == "4" {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rdr := bufio.NewReader(fsConn)
+	go func() {
+		if cmd, err := readMockCmd(rdr); err != nil {
+			t.Error(err)
+		} else if exp := "event plain HEARTBEAT\n"; cmd != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+		}
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK event listener enabled plain\n\n"))
+	}()
+	received := make(chan string, 3)
+	if err := fs.AddEventHandlerWithReplay("HEARTBEAT", func(ev string, _ int) {
+		received <- headerVal(ev, "Event-Sequence")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	writeEv("HEARTBEAT", 5)
+	var seqs []string
+	for i := 0; i < 2; i++ {
+		select {
+		case seq := <-received:
+			seqs = append(seqs, seq)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout after receiving events: %v", seqs)
+		}
+	}
+	if exp := []string{"4", "5"}; !reflect.DeepEqual(exp, seqs) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, seqs)
+	}
+}
+
+func TestFSockSendApiCmdRetries(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	var delays []time.Duration
+	fs.sleep = func(d time.Duration) { delays = append(delays, d) }
+	fs.SetApiRetries(3)
+	rplys := []string{"-ERR no reply\n", "-ERR no reply\n", "+OK\n", "-ERR no such channel\n"}
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for _, rply := range rplys {
+			if _, err := readMockCmd(rdr); err != nil {
+				return
+			}
+			fsConn.Write([]byte(fmt.Sprintf("Content-Type: api/response\nContent-Length: %d\n\n%s", len(rply), rply)))
+		}
+	}()
+	if rply, err := fs.SendApiCmd("uuid_kill 3d9bcd1f"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+	}
+	if exp := []time.Duration{ApiRetryDelay, ApiRetryDelay}; !reflect.DeepEqual(exp, delays) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, delays)
+	}
+	// permanent errors are not retried
+	if _, err := fs.SendApiCmd("uuid_kill 3d9bcd1f"); err == nil || err.Error() != "-ERR no such channel" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "-ERR no such channel", err)
+	}
+	if len(delays) != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, len(delays))
+	}
+}
+
+func TestFSockSendMsgCmdWithBodyFraming(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	body := "playback_terminators=none\nsay:" + strings.Repeat("long text to speech ", 10)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		cmd, err := readMockCmd(rdr)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if exp := fmt.Sprintf("sendmsg 3d9bcd1f\ncall-command: execute\ncontent-type: text/plain\ncontent-length: %d\n", len(body)); cmd != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+		}
+		rcvBody := make([]byte, len(body))
+		if _, err = io.ReadFull(rdr, rcvBody); err != nil {
+			t.Error(err)
+		} else if string(rcvBody) != body {
+			t.Errorf("\nExpected: %q, \nReceived: %q", body, rcvBody)
+		}
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+	}()
+	if err := fs.SendMsgCmdWithBody("3d9bcd1f", map[string]string{"call-command": "execute"}, body); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockSendMsgCmdNoUUID(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	go func() {
+		cmd, err := readMockCmd(bufio.NewReader(fsConn))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if exp := "sendmsg\ncall-command: hangup\n"; cmd != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+		}
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+	}()
+	if err := fs.SendMsgCmd("", map[string]string{"call-command": "hangup"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockSetDefaultEventLock(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.SetDefaultEventLock(true)
+	cmds := make(chan string, 2)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+		}
+	}()
+	cmdargs := map[string]string{"call-command": "execute", "execute-app-name": "playback", "execute-app-arg": "tone_stream://%(200,0,500)"}
+	if err := fs.SendMsgCmd("uuid-1", cmdargs); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := <-cmds; !strings.Contains(cmd, "\nevent-lock: true\n") {
+		t.Errorf("expected event-lock by default, received: %q", cmd)
+	}
+	if _, has := cmdargs["event-lock"]; has {
+		t.Error("the arguments of the caller were changed")
+	}
+	cmdargs["event-lock"] = "false"
+	if err := fs.SendMsgCmd("uuid-1", cmdargs); err != nil {
+		t.Fatal(err)
+	}
+	if cmd := <-cmds; !strings.Contains(cmd, "\nevent-lock: false\n") || strings.Contains(cmd, "event-lock: true") {
+		t.Errorf("expected event-lock overridden off, received: %q", cmd)
+	}
+}
+
+// mockOriginate replies to the commands, sending the event with the Event-Name given by evName for the originated channel
+func mockOriginate(fsConn net.Conn, evName string, cmds chan<- string) {
+	rdr := bufio.NewReader(fsConn)
+	for {
+		cmd, err := readMockCmd(rdr)
+		if err != nil {
+			return
+		}
+		cmds <- cmd
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+		if !strings.HasPrefix(cmd, "bgapi originate ") {
+			continue
+		}
+		uuid := strings.SplitN(cmd, "origination_uuid=", 2)[1]
+		uuid = uuid[:strings.IndexAny(uuid, ",}")]
+		ev := "Event-Name: " + evName + "\nUnique-ID: " + uuid + "\nHangup-Cause: USER_BUSY\n"
+		fmt.Fprintf(fsConn, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)
+	}
+}
+
+func TestFSockOriginateAndWait(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	cmds := make(chan string, 10)
+	go mockOriginate(fsConn, "CHANNEL_ANSWER", cmds)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	uuid, err := fs.OriginateAndWait(ctx, "user/1001", "&park()",
+		map[string]string{"origination_caller_id_number": "1000", "sip_h_X-Tags": "a,b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "event plain CHANNEL_ANSWER CHANNEL_HANGUP BACKGROUND_JOB\n"; <-cmds != exp {
+		t.Errorf("expected the subscription first")
+	}
+	bgapiCmd := <-cmds
+	if exp := "bgapi originate {origination_uuid=" + uuid + ",origination_caller_id_number=1000,sip_h_X-Tags=a\\,b}user/1001 &park()\nJob-UUID:"; !strings.HasPrefix(bgapiCmd, exp) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, bgapiCmd)
+	}
+	if exp, cmd := "nixevent CHANNEL_ANSWER CHANNEL_HANGUP BACKGROUND_JOB\n", <-cmds; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	if subscribed := fs.subscribedEvents(); len(subscribed) != 0 {
+		t.Errorf("unexpected subscriptions left: %q", subscribed)
+	}
+	jobDone := make(chan struct{}) // the job result arriving after the answer does not block
+	go func() {
+		fs.doBackgroundJob("Event-Name: BACKGROUND_JOB\nJob-UUID: " + strings.TrimSpace(strings.SplitN(bgapiCmd, "Job-UUID:", 2)[1]) + "\n\n+OK " + uuid)
+		close(jobDone)
+	}()
+	select {
+	case <-jobDone:
+	case <-time.After(time.Second):
+		t.Error("background job blocked")
+	}
+}
+
+func TestFSockOriginateAndWaitKeepsSubscriptions(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.bgapiSubsc = true
+	fs.events = map[string]bool{"CHANNEL_HANGUP": true}
+	cmds := make(chan string, 10)
+	go mockOriginate(fsConn, "CHANNEL_ANSWER", cmds)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := fs.OriginateAndWait(ctx, "user/1001", "&park()", nil); err != nil {
+		t.Fatal(err)
+	}
+	if exp, cmd := "event plain CHANNEL_ANSWER\n", <-cmds; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	<-cmds // bgapi originate
+	if exp, cmd := "nixevent CHANNEL_ANSWER\n", <-cmds; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	if exp, subscribed := []string{"CHANNEL_HANGUP"}, fs.subscribedEvents(); !reflect.DeepEqual(exp, subscribed) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, subscribed)
+	}
+}
+
+func TestFSockOriginateAndWaitSubscribedAll(t *testing.T) {
+	for _, handlerKey := range []string{"ALL", "CHANNEL_*"} {
+		fs, fsConn := newPipeFSock()
+		fs.bgapiSubsc = handlerKey != "ALL" // BACKGROUND_JOB covered by ALL only
+		received := make(chan string, 10)
+		fs.handlersMux.Lock()
+		fs.eventHandlers[handlerKey] = []func(string, int){func(ev string, _ int) { received <- eventName(ev) }}
+		fs.handlersMux.Unlock()
+		cmds := make(chan string, 10)
+		go mockOriginate(fsConn, "CHANNEL_ANSWER", cmds)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		if _, err := fs.OriginateAndWait(ctx, "user/1001", "&park()", nil); err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if cmd := <-cmds; !strings.HasPrefix(cmd, "bgapi originate ") {
+			t.Errorf("%s: unexpected command: %q", handlerKey, cmd)
+		}
+		select {
+		case cmd := <-cmds: // like nixevent, dropping the events from the subscription of the handler
+			t.Errorf("%s: unexpected command: %q", handlerKey, cmd)
+		default:
+		}
+		select {
+		case evName := <-received:
+			if evName != "CHANNEL_ANSWER" {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_ANSWER", evName)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: event not dispatched to the handler", handlerKey)
+		}
+		fsConn.Close()
+	}
+}
+
+func TestFSockOriginateAndWaitHangup(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	go mockOriginate(fsConn, "CHANNEL_HANGUP", make(chan string, 10))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	expErr := "Originate to <user/1001> failed: <USER_BUSY>"
+	if _, err := fs.OriginateAndWait(ctx, "user/1001", "&park()", nil); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+// logRecorder is a logger keeping the messages, safe for concurrent use
+type logRecorder struct {
+	nopLogger
+	mux  sync.Mutex
+	msgs []string // level: message
+}
+
+func (lR *logRecorder) record(lvl, msg string) error {
+	lR.mux.Lock()
+	lR.msgs = append(lR.msgs, lvl+": "+msg)
+	lR.mux.Unlock()
+	return nil
+}
+
+func (lR *logRecorder) Debug(msg string) error   { return lR.record("debug", msg) }
+func (lR *logRecorder) Err(msg string) error     { return lR.record("error", msg) }
+func (lR *logRecorder) Info(msg string) error    { return lR.record("info", msg) }
+func (lR *logRecorder) Warning(msg string) error { return lR.record("warning", msg) }
+
+func (lR *logRecorder) Msgs() []string {
+	lR.mux.Lock()
+	defer lR.mux.Unlock()
+	return append([]string{}, lR.msgs...)
+}
+
+func TestFSockSetLogger(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	first, second := new(logRecorder), new(logRecorder)
+	fs, err := NewFSockFromConfig(Config{Address: mFS.Addr(), Password: "ClueCon", Logger: first, ValidateEventNames: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	fs.SetLabel("node", "fs1")
+	fs.SetLogger(second)
+	if err := fs.AddEventHandler("CHANNEL_ANSWR", func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	expected := "warning: <FSock> Subscribing to unknown event name <CHANNEL_ANSWR>, check it for typos [node=fs1]"
+	if msgs := second.Msgs(); !isSliceMember(msgs, expected) {
+		t.Errorf("expected %q in %q", expected, msgs)
+	}
+	for _, msg := range first.Msgs() {
+		if strings.Contains(msg, "CHANNEL_ANSWR") {
+			t.Errorf("unexpected log on the replaced logger: %q", msg)
+		}
+	}
+}
+
+func TestFSockPoolSetLogger(t *testing.T) {
+	first, second := new(logRecorder), new(logRecorder)
+	pool := NewFSockPool(1, "127.0.0.1:1", "ClueCon", 0, 10*time.Millisecond,
+		nil, nil, first, 0, false)
+	pool.SetCircuitBreaker(1, 0, time.Minute)
+	pool.SetLogger(second)
+	if _, err := pool.PopFSock(); err == nil {
+		t.Fatal("expected connection error")
+	}
+	if msgs := second.Msgs(); !isSliceMember(msgs, "warning: <FSock> Opening the circuit breaker after 1 consecutive connection failures") {
+		t.Errorf("unexpected logs: %q", msgs)
+	}
+	if msgs := first.Msgs(); len(msgs) != 0 {
+		t.Errorf("unexpected logs on the replaced logger: %q", msgs)
+	}
+}
+
+func TestFSockdispatchEventHandlerPanic(t *testing.T) {
+	l := new(logRecorder)
+	handled := make(chan struct{})
+	fs := &FSock{
+		logger: l,
+		eventHandlers: map[string][]func(string, int){
+			"HEARTBEAT": {
+				func(string, int) { panic("buggy handler") },
+				func(string, int) { close(handled) },
+			},
+		},
+	}
+	fs.dispatchEvent("Event-Name: HEARTBEAT\n")
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("second handler not called")
+	}
+	for i := 0; i < 100 && len(l.Msgs()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if msgs := l.Msgs(); len(msgs) != 1 ||
+		!strings.HasPrefix(msgs[0], "error: <FSock> Handler for event HEARTBEAT panicked: buggy handler\ngoroutine ") {
+		t.Errorf("unexpected log messages: %q", msgs)
+	}
+}
+
+func TestFSockAddEventFilters(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	cmds := make(chan string, 2)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for i := 0; i < 2; i++ {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK filter added\n\n"))
+		}
+	}()
+	if err := fs.AddEventFilters([]EventFilter{
+		{Header: "Unique-ID", Value: "3d9bcd1f"},
+		{Header: "Unique-ID", Value: "7f4de4bc"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, exp := range []string{"filter Unique-ID 3d9bcd1f\n", "filter Unique-ID 7f4de4bc\n"} {
+		if cmd := <-cmds; cmd != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+		}
+	}
+	if exp := map[string][]string{"Unique-ID": {"3d9bcd1f", "7f4de4bc"}}; !reflect.DeepEqual(exp, fs.eventFilters) {
+		t.Errorf("\nExpected: %+v, \nReceived: %+v", exp, fs.eventFilters)
+	}
+}
+
+func TestFSockSetMyEvents(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 0, nil, nil, nopLogger{}, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	connCmds := len(mFS.Cmds())
+	if err = fs.SetMyEvents("3d9bcd1f", EventFilter{Header: "Event-Name", Value: "DTMF"}); err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"myevents plain 3d9bcd1f\n", "filter Event-Name DTMF\n"}
+	if cmds := mFS.Cmds()[connCmds:]; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmds)
+	}
+	connCmds = len(mFS.Cmds())
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	exp = []string{"auth ClueCon\n", "myevents plain 3d9bcd1f\n", "filter Event-Name DTMF\n", "event plain\n"}
+	if cmds := mFS.Cmds()[connCmds:]; !reflect.DeepEqual(exp, cmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmds)
+	}
+}
+
+func TestFSockfilterEventsKeepsFilters(t *testing.T) {
+	buf := new(bytes.Buffer)
+	fs := &FSock{
+		fsMutex: new(sync.RWMutex),
+		conn:    &connMock2{buf: buf},
+		buffer:  bufio.NewReader(bytes.NewBufferString(strings.Repeat("Content-Type: command/reply\nReply-Text: +OK\n\n", 4))),
+		logger:  nopLogger{},
+	}
+	filters := map[string][]string{"Event-Name": {"CHANNEL_ANSWER"}}
+	for i := 0; i < 2; i++ { // as on reconnect
+		if err := fs.filterEvents(filters, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exp := map[string][]string{"Event-Name": {"CHANNEL_ANSWER"}}; !reflect.DeepEqual(exp, filters) {
+		t.Errorf("\nExpected: %+v, \nReceived: %+v", exp, filters)
+	}
+	exp := strings.Repeat("filter Event-Name CHANNEL_ANSWER\n\nfilter Event-Name BACKGROUND_JOB\n\n", 2)
+	if rcv := buf.String(); rcv != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, rcv)
+	}
+}
+
+func TestFSockPoolWarmUpCtx(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsaddr := l.Addr().String()
+	l.Close() // nothing listening so the warm up keeps failing
+	pool := NewFSockPool(3, fsaddr, "ClueCon", 0, time.Second,
+		make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	pool.SetLogger(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	var mux sync.Mutex
+	var delays []time.Duration
+	pool.SetSleepFunc(func(d time.Duration) {
+		mux.Lock()
+		if delays = append(delays, d); len(delays) == 4 {
+			cancel()
+		}
+		mux.Unlock()
+	})
+	pool.SetMaxReconnectDelay(2 * time.Second)
+	pool.WarmUpCtx(ctx, 1)
+	for i := 0; i < 200 && len(pool.allowedConns) != 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(pool.allowedConns) != 3 { // the slot was given back once stopped
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 3, len(pool.allowedConns))
+	}
+	mux.Lock()
+	defer mux.Unlock()
+	if exp := []time.Duration{time.Second, time.Second, 2 * time.Second, 2 * time.Second}; !reflect.DeepEqual(exp, delays) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, delays)
+	}
+}
+
+func TestFSockPoolWarmUp(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	pool := NewFSockPool(3, mFS.Addr(), "ClueCon", 1, time.Second,
+		make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	pool.WarmUp(2)
+	for i := 0; i < 100 && len(pool.fSocks) != 2; i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(pool.fSocks) != 2 {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 2, len(pool.fSocks))
+	}
+	if len(pool.allowedConns) != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, len(pool.allowedConns))
+	}
+	if mFS.Accepted() != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, mFS.Accepted())
+	}
+	fsk, err := pool.PopFSock() // from the warm sockets
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsk.Disconnect()
+	if mFS.Accepted() != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, mFS.Accepted())
+	}
+}
+
+func TestFSockAuthReplies(t *testing.T) {
+	testAuth := func(rply string) error {
+		clntConn, fsConn := net.Pipe()
+		defer clntConn.Close()
+		defer fsConn.Close()
+		fs := &FSock{
+			fsMutex: new(sync.RWMutex),
+			conn:    clntConn,
+			buffer:  bufio.NewReader(clntConn),
+			fspaswd: "ClueCon",
+			logger:  nopLogger{},
+		}
+		go func() {
+			if _, err := readMockCmd(bufio.NewReader(fsConn)); err != nil {
+				return
+			}
+			fsConn.Write([]byte(rply))
+		}()
+		return fs.auth()
+	}
+	if err := testAuth("Content-Type: command/reply\nReply-Text: +OK accepted\n\n"); err != nil {
+		t.Error(err)
+	}
+	err := testAuth("Content-Type: command/reply\nReply-Text: -ERR invalid\n\n")
+	if !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrAuthRejected, err)
+	} else if expected := "Authentication rejected: <-ERR invalid>"; err.Error() != expected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, err)
+	}
+	rply := "Content-Type: text/disconnect-notice\nContent-Length: 0\n"
+	err = testAuth(rply + "\n")
+	if errors.Is(err, ErrAuthRejected) {
+		t.Errorf("unexpected auth rejection for protocol error: %v", err)
+	} else if expected := fmt.Sprintf("Unexpected auth reply received: <%s>", rply); err == nil || err.Error() != expected {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, err)
+	}
+}
+
+func TestFSockSetEventAllowlist(t *testing.T) {
+	l := new(logRecorder)
+	evs := make(chan string, 3)
+	fs := &FSock{
+		logger: l,
+		eventHandlers: map[string][]func(string, int){
+			"ALL": {func(ev string, _ int) { evs <- eventName(ev) }},
+		},
+	}
+	fs.SetEventAllowlist("CHANNEL_ANSWER")
+	fs.dispatchEvent("Event-Name: HEARTBEAT\n")
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\n")
+	fs.dispatchEvent("Event-Name: CHANNEL_HANGUP\n")
+	select {
+	case evName := <-evs:
+		if evName != "CHANNEL_ANSWER" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_ANSWER", evName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("allowed event not dispatched")
+	}
+	select {
+	case evName := <-evs:
+		t.Errorf("unexpected event dispatched: %s", evName)
+	case <-time.After(20 * time.Millisecond):
+	}
+	expected := []string{
+		"debug: <FSock> Dropping event HEARTBEAT, not in the allowlist",
+		"debug: <FSock> Dropping event CHANNEL_HANGUP, not in the allowlist",
+	}
+	if msgs := l.Msgs(); !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, msgs)
+	}
+
+	fs.SetEventAllowlist() // disabled
+	fs.dispatchEvent("Event-Name: HEARTBEAT\n")
+	select {
+	case evName := <-evs:
+		if evName != "HEARTBEAT" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "HEARTBEAT", evName)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("event not dispatched with the allowlist disabled")
+	}
+}
+
+func TestFSockEventsChan(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.SetEventsChanOptions(3, false)
+	evChan := fs.EventsChan()
+	if evChan2 := fs.EventsChan(); evChan2 != evChan {
+		t.Error("expected the same events channel")
+	}
+	for i := 0; i < 3; i++ {
+		ev := fmt.Sprintf("Event-Name: HEARTBEAT\nEvent-Sequence: %d\n", i)
+		fmt.Fprintf(fsConn, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-evChan:
+			if ev.Name != "HEARTBEAT" {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "HEARTBEAT", ev.Name)
+			}
+			if seq := ev.Get("Event-Sequence"); seq != strconv.Itoa(i) {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", i, seq)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d not received", i)
+		}
+	}
+}
+
+func TestFSockEventsChanDropOnFull(t *testing.T) {
+	l := new(logRecorder)
+	fs := &FSock{logger: l}
+	fs.SetEventsChanOptions(1, true)
+	evChan := fs.EventsChan()
+	fs.dispatchEvent("Event-Name: HEARTBEAT\nEvent-Sequence: 1\n")
+	fs.dispatchEvent("Event-Name: HEARTBEAT\nEvent-Sequence: 2\n")
+	if ev := <-evChan; ev.Get("Event-Sequence") != "1" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "1", ev.Get("Event-Sequence"))
+	}
+	expected := []string{"warning: <FSock> Events channel full, dropping event HEARTBEAT"}
+	if msgs := l.Msgs(); !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, msgs)
+	}
+}
+
+func TestFSockEventsChanStalledClose(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	ev := "Event-Name: HEARTBEAT\n"
+	frame := fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)
+	mFS.SetReply("api heartbeats", frame+frame+frame+"Content-Type: api/response\nContent-Length: 4\n\n+OK\n")
+	fs, err := NewFSockFromConfig(Config{Address: mFS.Addr(), Password: "ClueCon", CmdTimeout: time.Second, EventsChanSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evChan := fs.EventsChan() // never read, the reading blocks on the second event
+	go fs.SendApiCmd("heartbeats")
+	for i := 0; len(evChan) == 0; i++ {
+		if i == 100 {
+			t.Fatal("event not received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	closed := make(chan struct{})
+	go func() {
+		fs.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close blocked by the stalled EventsChan consumer")
+	}
+}
+
+func TestFSockEventsChanDefaultBuffer(t *testing.T) {
+	fs := &FSock{logger: nopLogger{}}
+	if size := cap(fs.EventsChan()); size != EventsChanBuffer {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", EventsChanBuffer, size)
+	}
+}
+
+func TestFSockSynchronousDispatch(t *testing.T) {
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: nopLogger{}}
+	fs.SetSynchronousDispatch(true)
+	var received []string // not locked, the race detector fails the test if the handlers run concurrently
+	fs.AddEventHandler("CHANNEL_ANSWER", func(event string, _ int) {
+		received = append(received, "answer "+headerVal(event, "Event-Sequence"))
+	})
+	fs.AddEventHandler("CHANNEL_ANSWER", func(event string, _ int) {
+		received = append(received, "answer2 "+headerVal(event, "Event-Sequence"))
+	})
+	fs.AddEventHandler("ALL", func(event string, _ int) {
+		received = append(received, "all "+headerVal(event, "Event-Sequence"))
+	})
+	var expected []string
+	for i := 0; i < 20; i++ {
+		evName, handlers := "CHANNEL_ANSWER", []string{"answer", "answer2", "all"}
+		if i%2 == 1 {
+			evName, handlers = "HEARTBEAT", []string{"all"}
+		}
+		fs.dispatchEvent(fmt.Sprintf("Event-Name: %s\nEvent-Sequence: %d\n", evName, i))
+		for _, handler := range handlers {
+			expected = append(expected, fmt.Sprintf("%s %d", handler, i))
+		}
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, received)
+	}
+}
+
+// newQueuedPipeFSock returns a socket reading from the pipe through an event queue, its events handled by the slow handler
+func newQueuedPipeFSock(size int, policy EventQueuePolicy, handler func(string, int)) (fs *FSock, fsConn net.Conn) {
+	clntConn, fsConn := net.Pipe()
+	fs = &FSock{
+		fsMutex:         new(sync.RWMutex),
+		conn:            clntConn,
+		buffer:          bufio.NewReader(clntConn),
+		eventHandlers:   map[string][]func(string, int){"HEARTBEAT": {handler}},
+		backgroundChans: make(map[string]chan string),
+		logger:          nopLogger{},
+		stopReadEvents:  make(chan struct{}),
+		errReadEvents:   make(chan error, 1),
+	}
+	fs.SetSynchronousDispatch(true)
+	fs.SetEventQueue(size, policy)
+	go fs.readEvents(fs.stopReadEvents, fs.errReadEvents)
+	return
+}
+
+func writeHeartbeat(fsConn net.Conn, seq int) error {
+	ev := fmt.Sprintf("Event-Name: HEARTBEAT\nEvent-Sequence: %d\n", seq)
+	_, err := fmt.Fprintf(fsConn, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)
+	return err
+}
+
+func TestFSockEventQueueBlock(t *testing.T) {
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	received := make(chan string, 10)
+	fs, fsConn := newQueuedPipeFSock(2, EventQueueBlock, func(event string, _ int) {
+		started <- struct{}{}
+		<-release
+		received <- headerVal(event, "Event-Sequence")
+	})
+	defer fsConn.Close()
+	if err := writeHeartbeat(fsConn, 1); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	for i := 2; i <= 4; i++ { // two queued and one read, waiting for room
+		if err := writeHeartbeat(fsConn, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsConn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if err := writeHeartbeat(fsConn, 5); err == nil {
+		t.Fatal("expected the reading to stop while the queue is full")
+	}
+	fsConn.SetWriteDeadline(time.Time{})
+	close(release)
+	for i := 1; i <= 4; i++ {
+		if seq := <-received; seq != strconv.Itoa(i) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", i, seq)
+		}
+	}
+	if dropped := fs.Stats().QueueDropped; dropped != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, dropped)
+	}
+}
+
+func TestFSockEventQueueDropOldest(t *testing.T) {
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	received := make(chan string, 10)
+	fs, fsConn := newQueuedPipeFSock(2, EventQueueDropOldest, func(event string, _ int) {
+		started <- struct{}{}
+		<-release
+		received <- headerVal(event, "Event-Sequence")
+	})
+	defer fsConn.Close()
+	if err := writeHeartbeat(fsConn, 1); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	fsConn.SetWriteDeadline(time.Now().Add(time.Second))
+	for i := 2; i <= 6; i++ { // reading goes on, keeping the last two
+		if err := writeHeartbeat(fsConn, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; fs.Stats().QueueDropped != 3; i++ {
+		if i == 1000 {
+			t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 3, fs.Stats().QueueDropped)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for _, exp := range []string{"1", "5", "6"} {
+		if seq := <-received; seq != exp {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, seq)
+		}
+	}
+}
+
+func TestFSockDispatchEventALL(t *testing.T) {
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: nopLogger{}}
+	fs.SetSynchronousDispatch(true)
+	var received []string
+	fs.AddEventHandler("CHANNEL_ANSWER", func(event string, _ int) {
+		received = append(received, "answer "+eventName(event))
+	})
+	fs.AddEventHandler("CHANNEL_*", func(event string, _ int) {
+		received = append(received, "wildcard "+eventName(event))
+	})
+	fs.AddEventHandler("ALL", func(event string, _ int) {
+		received = append(received, "all "+eventName(event))
+	})
+	for _, evName := range []string{"CHANNEL_ANSWER", "CHANNEL_HANGUP", "HEARTBEAT"} {
+		fs.dispatchEvent("Event-Name: " + evName + "\n")
+	}
+	expected := []string{
+		"answer CHANNEL_ANSWER", "all CHANNEL_ANSWER",
+		"wildcard CHANNEL_HANGUP", "all CHANNEL_HANGUP",
+		"all HEARTBEAT",
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, received)
+	}
+}
+
+func TestFSockSynchronousDispatchCmdFromHandler(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	fs.SetSynchronousDispatch(true)
+	rplys := make(chan string, 2)
+	fs.handlersMux.Lock()
+	fs.eventHandlers["HEARTBEAT"] = []func(string, int){func(event string, _ int) {
+		rply, err := fs.SendApiCmd("status") // its reply is read meanwhile by the reading goroutine
+		if err != nil {
+			t.Error(err)
+		}
+		rplys <- headerVal(event, "Event-Sequence") + " " + rply
+	}}
+	fs.handlersMux.Unlock()
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for i := 1; i <= 2; i++ {
+			if err := writeHeartbeat(fsConn, i); err != nil {
+				return
+			}
+		}
+		for i := 1; i <= 2; i++ {
+			if _, err := readMockCmd(rdr); err != nil {
+				return
+			}
+			rply := fmt.Sprintf("+OK %d\n", i)
+			fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(rply), rply)
+		}
+	}()
+	for _, exp := range []string{"1 +OK 1\n", "2 +OK 2\n"} { // the second handler waits for the first one
+		select {
+		case rply := <-rplys:
+			if rply != exp {
+				t.Errorf("\nExpected: %q, \nReceived: %q", exp, rply)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("command from the synchronous handler blocked")
+		}
+	}
+}
+
+func TestFSockDispatchEventNoName(t *testing.T) {
+	l := new(logRecorder)
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: l}
+	fs.AddEventHandler("ALL", func(string, int) { t.Error("unexpected dispatch") })
+	for i := 0; i < 100; i++ {
+		fs.dispatchEvent("Log-Level: 7\nText-Channel: 3\n")
+	}
+	msgs := l.Msgs()
+	if len(msgs) != 100 {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 100, len(msgs))
+	}
+	for _, msg := range msgs {
+		if !strings.HasPrefix(msg, "debug: <FSock> Dropping frame without Event-Name") {
+			t.Errorf("unexpected log: %q", msg)
+		}
+	}
+}
+
+func TestFSockPauseDispatch(t *testing.T) {
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: nopLogger{}}
+	fs.SetSynchronousDispatch(true)
+	var received []string
+	fs.AddEventHandler("HEARTBEAT", func(event string, _ int) {
+		received = append(received, headerVal(event, "Event-Sequence"))
+	})
+	fs.PauseDispatch(2)
+	for i := 1; i <= 3; i++ {
+		fs.dispatchEvent(fmt.Sprintf("Event-Name: HEARTBEAT\nEvent-Sequence: %d\n", i))
+	}
+	if len(received) != 0 {
+		t.Errorf("events dispatched while paused: %q", received)
+	}
+	fs.ResumeDispatch()
+	fs.dispatchEvent("Event-Name: HEARTBEAT\nEvent-Sequence: 4\n")
+	if expected := []string{"1", "2", "4"}; !reflect.DeepEqual(expected, received) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, received)
+	}
+	received = nil
+	fs.PauseDispatch(0)
+	fs.dispatchEvent("Event-Name: HEARTBEAT\nEvent-Sequence: 5\n")
+	fs.ResumeDispatch()
+	fs.dispatchEvent("Event-Name: HEARTBEAT\nEvent-Sequence: 6\n")
+	if expected := []string{"6"}; !reflect.DeepEqual(expected, received) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, received)
+	}
+}
+
+func TestFSockOtherFrameHandler(t *testing.T) {
+	events := make(chan string, 1)
+	fs, fsConn := newQueuedPipeFSock(1, EventQueueBlock, func(event string, _ int) { events <- event })
+	defer fsConn.Close()
+	frames := make(chan []string, 1)
+	fs.SetOtherFrameHandler(func(contentType, header, body string) {
+		frames <- []string{contentType, header, body}
+	})
+	body := "2023-01-01 [DEBUG] switch_core.c:100 Test\n"
+	if _, err := fsConn.Write([]byte("Content-Type: log/data\nLog-Level: 7\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\n\n" + body)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case frame := <-frames:
+		if frame[0] != "log/data" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "log/data", frame[0])
+		}
+		if !strings.Contains(frame[1], "Log-Level: 7") {
+			t.Errorf("unexpected header: %q", frame[1])
+		}
+		if frame[2] != body {
+			t.Errorf("\nExpected: %q, \nReceived: %q", body, frame[2])
+		}
+	case <-time.After(time.Second):
+		t.Fatal("frame not received")
+	}
+	if err := writeHeartbeat(fsConn, 1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+	case frame := <-frames:
+		t.Errorf("event passed to the frame handler: %q", frame)
+	case <-time.After(time.Second):
+		t.Fatal("event not dispatched")
+	}
+}
+
+func TestFSockOnLog(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	logs := make(chan []string, 1)
+	fs.OnLog(func(level, line string) { logs <- []string{level, line} })
+	fs.SetOtherFrameHandler(func(contentType, _, _ string) { t.Errorf("unexpected frame: %s", contentType) })
+	line := "2023-01-01 10:00:00.000000 [WARNING] switch_core.c:100 Test\n"
+	if _, err := fmt.Fprintf(fsConn, "Content-Type: log/data\nLog-Level: 4\nContent-Length: %d\n\n%s", len(line), line); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case logLine := <-logs:
+		if expected := []string{"4", line}; !reflect.DeepEqual(expected, logLine) {
+			t.Errorf("\nExpected: %q, \nReceived: %q", expected, logLine)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("log line not received")
+	}
+}
+
+func TestFSockOnDisconnectNotice(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	noticed := make(chan bool, 1)
+	fs.OnDisconnectNotice(func() { noticed <- fs.Connected() })
+	notice := "Disconnected, goodbye.\n"
+	if _, err := fmt.Fprintf(fsConn, "Content-Type: text/disconnect-notice\nContent-Length: %d\n\n%s", len(notice), notice); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case connected := <-noticed:
+		if !connected {
+			t.Error("expected the handler to run before the disconnect")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("disconnect notice handler not called")
+	}
+	if err := <-fs.errReadEvents; err != ErrConnectionClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConnectionClosed, err)
+	}
+}
+
+func TestFSockSequenceTracking(t *testing.T) {
+	l := new(logRecorder)
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: l}
+	var gaps [][2]uint64
+	fs.SetSequenceTracking(true, func(expected, received uint64) {
+		gaps = append(gaps, [2]uint64{expected, received})
+	})
+	for _, seq := range []int{100, 101, 104, 105, 105, 3, 4, 6} {
+		fs.dispatchEvent(fmt.Sprintf("Event-Name: HEARTBEAT\nEvent-Sequence: %d\n", seq))
+	}
+	fs.dispatchEvent("Event-Name: HEARTBEAT\n") // no sequence, ignored
+	expected := [][2]uint64{{102, 104}, {5, 6}}
+	if !reflect.DeepEqual(expected, gaps) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, gaps)
+	}
+	if dropped := fs.Stats().DroppedEvents; dropped != 3 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, dropped)
+	}
+	if msgs := l.Msgs(); !isSliceMember(msgs, "warning: <FSock> Event-Sequence gap, expected 102, received 104") {
+		t.Errorf("gap not logged: %q", msgs)
+	}
+}
+
+func TestFSockCharsetDecoder(t *testing.T) {
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: nopLogger{}}
+	fs.SetSynchronousDispatch(true)
+	fs.SetCharsetDecoder(DecodeLatin1, "Caller-Caller-ID-Name")
+	var received []string
+	fs.AddEventHandler("CHANNEL_ANSWER", func(event string, _ int) {
+		ev := NewEvent(event)
+		received = append(received, ev.Get("Caller-Caller-ID-Name"), ev.Get("Other-Leg-Caller-ID-Name"))
+	})
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\nCaller-Caller-ID-Name: Jos%E9%20Mu%F1oz\nOther-Leg-Caller-ID-Name: Jos%E9\n")
+	if exp := []string{"José Muñoz", "Jos\xe9"}; !reflect.DeepEqual(exp, received) { // only the listed headers decoded
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, received)
+	}
+
+	received = nil
+	fs.SetCharsetDecoder(nil)
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\nCaller-Caller-ID-Name: Jos%E9\n")
+	if exp := []string{"Jos\xe9", ""}; !reflect.DeepEqual(exp, received) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, received)
+	}
+}
+
+func TestFSockEventTransform(t *testing.T) {
+	l := new(logRecorder)
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: l}
+	fs.SetSynchronousDispatch(true)
+	fs.SetEventTransform(func(ev *Event) *Event {
+		if ev.Get("Unique-ID") == "" {
+			return nil
+		}
+		ev.Headers["Tenant-ID"] = "tenant 1"
+		return ev
+	})
+	var received []string
+	fs.AddEventHandler("CHANNEL_ANSWER", func(event string, _ int) {
+		received = append(received, headerVal(event, "Unique-ID")+" "+urlDecode(headerVal(event, "Tenant-ID")))
+	})
+	fs.SetEventsChanOptions(2, false)
+	evChan := fs.EventsChan()
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: uuid1\n")
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\n") // dropped by the transform
+	if exp := []string{"uuid1 tenant 1"}; !reflect.DeepEqual(exp, received) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp, received)
+	}
+	if ev := <-evChan; ev.Get("Tenant-ID") != "tenant 1" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "tenant 1", ev.Get("Tenant-ID"))
+	}
+	select {
+	case ev := <-evChan:
+		t.Errorf("unexpected event: %+v", ev)
+	default:
+	}
+	if msgs := l.Msgs(); !isSliceMember(msgs, "debug: <FSock> Dropping event CHANNEL_ANSWER, discarded by the transform") {
+		t.Errorf("drop not logged: %q", msgs)
+	}
+}
+
+func TestFSockSubscribeUUID(t *testing.T) {
+	l := new(logRecorder)
+	fs := &FSock{logger: l}
+	chan1, cancel1 := fs.SubscribeUUID("uuid1")
+	chan2, cancel2 := fs.SubscribeUUID("uuid2")
+	defer cancel2()
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: uuid1\n")
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\nUnique-ID: uuid2\n")
+	fs.dispatchEvent("Event-Name: CHANNEL_HANGUP\nUnique-ID: uuid1\n")
+	fs.dispatchEvent("Event-Name: CHANNEL_HANGUP\nUnique-ID: uuid3\n")
+	for _, exp := range []string{"CHANNEL_ANSWER", "CHANNEL_HANGUP"} {
+		if ev := <-chan1; ev.Name != exp || ev.Get("Unique-ID") != "uuid1" {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", exp+" uuid1", ev.Name+" "+ev.Get("Unique-ID"))
+		}
+	}
+	if ev := <-chan2; ev.Name != "CHANNEL_ANSWER" || ev.Get("Unique-ID") != "uuid2" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "CHANNEL_ANSWER uuid2", ev.Name+" "+ev.Get("Unique-ID"))
+	}
+	select {
+	case ev := <-chan2:
+		t.Errorf("unexpected event: %+v", ev)
+	default:
+	}
+	cancel1()
+	cancel1() // canceling twice is safe
+	if _, open := <-chan1; open {
+		t.Error("expected the channel closed after cancel")
+	}
+	fs.dispatchEvent("Event-Name: CHANNEL_DESTROY\nUnique-ID: uuid1\n")
+	expected := []string{
+		"warning: <FSock> No dispatcher for event: <Event-Name: CHANNEL_HANGUP\nUnique-ID: uuid3\n> with event name: CHANNEL_HANGUP",
+		"warning: <FSock> No dispatcher for event: <Event-Name: CHANNEL_DESTROY\nUnique-ID: uuid1\n> with event name: CHANNEL_DESTROY",
+	}
+	if msgs := l.Msgs(); !reflect.DeepEqual(msgs, expected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, msgs)
+	}
+}
+
+func TestFSockPoolReconnects(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	pool := NewFSockPool(1, mFS.Addr(), "ClueCon", 5, time.Second,
+		make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	fsk, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fsk.Disconnect()
+	if fsk.reconnects != 5 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 5, fsk.reconnects)
+	}
+}
+
+func TestFSockConnectCtxCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() { // accept but never send the auth challenge
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	fs, err := NewFSockLazy(l.Addr().String(), "ClueCon", 1, nil, nil, nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	errChan := make(chan error, 1)
+	go func() { errChan <- fs.ConnectCtx(ctx) }()
+	select {
+	case err := <-errChan:
+		if err != context.Canceled {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.Canceled, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ConnectCtx not returning on cancel")
+	}
+	if fs.Connected() {
+		t.Error("expected not connected")
+	}
+}
+
+func TestFSockConnectCtx(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockLazy(mFS.Addr(), "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := fs.ConnectCtx(ctx); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	cancel() // the established connection is not affected by the context anymore
+	if rply, err := fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	} else if rply != "+OK\n" {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "+OK\n", rply)
+	}
+}
+
+func TestFSockSetPassword(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	mFS.SetPasswd("NewClueCon")
+	if err = fs.Reconnect(); !errors.Is(err, ErrAuthRejected) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrAuthRejected, err)
+	}
+	fs.SetPassword("NewClueCon")
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.Connected() {
+		t.Error("expected connected with the new password")
+	}
+	if cmds := mFS.Cmds(); cmds[len(cmds)-2] != "auth NewClueCon\n" {
+		t.Errorf("unexpected commands: %q", cmds)
+	}
+}
+
+func TestFSockSetTrace(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	l := new(logRecorder)
+	fs, err := NewFSockLazy(mFS.Addr(), "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), l, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.SetTrace(true)
+	if err = fs.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetTrace(false)
+	if _, err = fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	fs.Disconnect()
+	var traced []string
+	for _, msg := range l.Msgs() {
+		if strings.HasPrefix(msg, "debug: ") {
+			traced = append(traced, msg)
+		}
+	}
+	expected := []string{
+		"debug: <FSock> Received headers: <Content-Type: auth/request\n>",
+		"debug: <FSock> Sent: <auth ****\n\n>",
+		"debug: <FSock> Received headers: <Content-Type: command/reply\nReply-Text: +OK accepted\n>",
+		"debug: <FSock> Sent: <event plain\n\n>",
+		"debug: <FSock> Received headers: <Content-Type: command/reply\nReply-Text: +OK\n>",
+		"debug: <FSock> Sent: <api status\n\n>",
+		"debug: <FSock> Received headers: <Content-Type: api/response\nContent-Length: 4\n>",
+		"debug: <FSock> Received body: <+OK\n>",
+	}
+	if !reflect.DeepEqual(expected, traced) {
+		t.Errorf("\nExpected: <%q>, \nReceived: <%q>", expected, traced)
+	}
+	for _, msg := range l.Msgs() {
+		if strings.Contains(msg, "ClueCon") {
+			t.Errorf("password leaked in logs: %q", msg)
+		}
+	}
+}
+
+func TestFSockChannelExists(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	cmds := make(chan string, 3)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for _, rply := range []string{"true", "false", "-USAGE: <uuid>\n"} {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(rply), rply)
+		}
+	}()
+	if exists, err := fs.ChannelExists("3d9bcd1f"); err != nil || !exists {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", true, exists, err)
+	}
+	if cmd, exp := <-cmds, "api uuid_exists 3d9bcd1f\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	if exists, err := fs.ChannelExists("7f4de4bc"); err != nil || exists {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", false, exists, err)
+	}
+	expErr := "Unexpected uuid_exists reply received: <-USAGE: <uuid>>"
+	if _, err := fs.ChannelExists(""); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockHangup(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	cmds := make(chan string, 3)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for _, rply := range []string{"+OK\n", "-ERR No such channel!\n", "-USAGE: <uuid> [cause]\n"} {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(rply), rply)
+		}
+	}()
+	if err := fs.Hangup("3d9bcd1f", ""); err != nil {
+		t.Error(err)
+	}
+	if cmd, exp := <-cmds, "api uuid_kill 3d9bcd1f NORMAL_CLEARING\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	if err := fs.Hangup("3d9bcd1f", "USER_BUSY"); !errors.Is(err, ErrNoSuchChannel) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNoSuchChannel, err)
+	}
+	if cmd, exp := <-cmds, "api uuid_kill 3d9bcd1f USER_BUSY\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	expErr := "Unexpected uuid_kill reply received: <-USAGE: <uuid> [cause]>"
+	if err := fs.Hangup("", ""); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockHangupMsg(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	cmds := make(chan string, 2)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for _, rply := range []string{"+OK", "-ERR invalid session id [7f4de4bc]"} {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			fmt.Fprintf(fsConn, "Content-Type: command/reply\nReply-Text: %s\n\n", rply)
+		}
+	}()
+	if err := fs.HangupMsg("3d9bcd1f", "USER_BUSY"); err != nil {
+		t.Error(err)
+	}
+	cmd := strings.Split(strings.TrimSuffix(<-cmds, "\n"), "\n")
+	sort.Strings(cmd[1:]) // the headers come in map order
+	if exp := []string{"sendmsg 3d9bcd1f", "call-command: hangup", "hangup-cause: USER_BUSY"}; !reflect.DeepEqual(exp, cmd) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	expErr := "-ERR invalid session id [7f4de4bc]"
+	if err := fs.HangupMsg("7f4de4bc", ""); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	if cmd := <-cmds; !strings.Contains(cmd, "hangup-cause: NORMAL_CLEARING\n") {
+		t.Errorf("expected the default hangup cause, received: %q", cmd)
+	}
+}
+
+func TestFSockBridge(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	cmds := make(chan string, 4)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for _, rply := range []string{"+OK\n", "-ERR Invalid uuid bbbb\n", "-ERR Invalid uuid aaaa\n", "-USAGE: <uuid> <other_uuid>\n"} {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(rply), rply)
+		}
+	}()
+	if err := fs.Bridge("aaaa", "bbbb"); err != nil {
+		t.Error(err)
+	}
+	if cmd, exp := <-cmds, "api uuid_bridge aaaa bbbb\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	for _, expErr := range []string{
+		"Bridge of <aaaa> with <bbbb> failed on <bbbb>: -ERR Invalid uuid bbbb",
+		"Bridge of <aaaa> with <bbbb> failed on <aaaa>: -ERR Invalid uuid aaaa",
+	} {
+		if err := fs.Bridge("aaaa", "bbbb"); err == nil || err.Error() != expErr {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+		}
+		<-cmds
+	}
+	expErr := "Unexpected uuid_bridge reply received: <-USAGE: <uuid> <other_uuid>>"
+	if err := fs.Bridge("aaaa", ""); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockAttXfer(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	cmds := make(chan string, 3)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for _, rply := range []string{"+OK\n", "-ERR No such channel!\n", "-ERR Permission denied\n"} {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(rply), rply)
+		}
+	}()
+	if err := fs.AttXfer("3d9bcd1f", "user/1001"); err != nil {
+		t.Error(err)
+	}
+	if cmd, exp := <-cmds, "api uuid_transfer 3d9bcd1f 'att_xfer:user/1001' inline\n"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	if err := fs.AttXfer("3d9bcd1f", "user/1001"); !errors.Is(err, ErrNoSuchChannel) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrNoSuchChannel, err)
+	}
+	<-cmds
+	expErr := "Attended transfer of <3d9bcd1f> to <user/1001> failed: -ERR Permission denied"
+	if err := fs.AttXfer("3d9bcd1f", "user/1001"); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockFsctl(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	rplys := make(chan string, 1)
+	cmds := make(chan string, 1)
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- cmd
+			rply := <-rplys
+			fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(rply), rply)
+		}
+	}()
+	for _, tc := range []struct {
+		call   func() error
+		cmd    string
+		rply   string
+		expErr string
+	}{
+		{call: fs.Pause, cmd: "api fsctl pause\n", rply: "+OK\n"},
+		{call: fs.Resume, cmd: "api fsctl resume\n", rply: "+OK\n"},
+		{call: func() error { return fs.HupAll("") }, cmd: "api hupall NORMAL_CLEARING\n",
+			rply: "+OK hangup all channels with cause NORMAL_CLEARING\n"},
+		{call: func() error { return fs.HupAll("MANAGER_REQUEST") }, cmd: "api hupall MANAGER_REQUEST\n",
+			rply: "-ERR Permission denied\n", expErr: "-ERR Permission denied"},
+		{call: fs.Pause, cmd: "api fsctl pause\n", rply: "-USAGE: fsctl pause [inbound|outbound]\n",
+			expErr: "Unexpected fsctl pause reply received: <-USAGE: fsctl pause [inbound|outbound]>"},
+	} {
+		rplys <- tc.rply
+		err := tc.call()
+		if cmd := <-cmds; cmd != tc.cmd {
+			t.Errorf("\nExpected: %q, \nReceived: %q", tc.cmd, cmd)
+		}
+		if tc.expErr == "" && err != nil {
+			t.Errorf("%s: %v", tc.cmd, err)
+		} else if tc.expErr != "" && (err == nil || err.Error() != tc.expErr) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", tc.expErr, err)
+		}
+	}
+}
+
+func TestFSockConnectFiltersBeforeEvents(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1,
+		map[string][]func(string, int){"CHANNEL_ANSWER": {func(string, int) {}}},
+		map[string][]string{"Event-Name": {"CHANNEL_ANSWER"}}, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	expected := []string{
+		"auth ClueCon\n",
+		"filter Event-Name CHANNEL_ANSWER\n",
+		"event plain CHANNEL_ANSWER\n",
+	}
+	if cmds := mFS.Cmds(); !reflect.DeepEqual(expected, cmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, cmds)
+	}
+}
+
+func TestFSockdispatchEventWildcard(t *testing.T) {
+	evs := make(chan string, 3)
+	fs := &FSock{
+		logger: nopLogger{},
+		eventHandlers: map[string][]func(string, int){
+			"CHANNEL_*":      {func(ev string, _ int) { evs <- "CHANNEL_*: " + eventName(ev) }},
+			"CHANNEL_A*":     {func(ev string, _ int) { evs <- "CHANNEL_A*: " + eventName(ev) }},
+			"CHANNEL_HANGUP": {func(ev string, _ int) { evs <- "CHANNEL_HANGUP: " + eventName(ev) }},
+		},
+	}
+	for _, evName := range []string{"CHANNEL_CREATE", "DTMF", "CHANNEL_ANSWER", "CHANNEL_HANGUP"} {
+		fs.dispatchEvent("Event-Name: " + evName + "\n")
+	}
+	var received []string
+	for i := 0; i < 3; i++ {
+		select {
+		case ev := <-evs:
+			received = append(received, ev)
+		case <-time.After(time.Second):
+			t.Fatal("event not dispatched")
+		}
+	}
+	sort.Strings(received)
+	expected := []string{
+		"CHANNEL_*: CHANNEL_CREATE",
+		"CHANNEL_A*: CHANNEL_ANSWER",
+		"CHANNEL_HANGUP: CHANNEL_HANGUP",
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, received)
+	}
+	select {
+	case ev := <-evs:
+		t.Errorf("unexpected event dispatched: %s", ev)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if cmd, exp := eventsPlainCmd([]string{"HEARTBEAT", "CHANNEL_A*", "CHANNEL_ANSWER"}, true),
+		"event plain HEARTBEAT CHANNEL_ANSWER CHANNEL_APPLICATION BACKGROUND_JOB"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	if cmd := eventsPlainCmd([]string{"HEARTBEAT", "CUSTOM sofia::*"}, true); cmd != "event plain all" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "event plain all", cmd)
+	}
+}
+
+func TestFSockConnectedSince(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockLazy(mFS.Addr(), "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if since := fs.ConnectedSince(); !since.IsZero() {
+		t.Errorf("expected zero time, received: %v", since)
+	}
+	if uptime := fs.Uptime(); uptime != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, uptime)
+	}
+	before := time.Now()
+	if err = fs.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	since := fs.ConnectedSince()
+	if since.Before(before) || since.After(time.Now()) {
+		t.Errorf("unexpected connect time: %v", since)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if uptime := fs.Uptime(); uptime < 5*time.Millisecond {
+		t.Errorf("unexpected uptime: %v", uptime)
+	}
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if newSince := fs.ConnectedSince(); !newSince.After(since) {
+		t.Errorf("expected connect time after %v, received: %v", since, newSince)
+	}
+	fs.Disconnect()
+	if uptime := fs.Uptime(); uptime != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, uptime)
+	}
+}
+
+func TestFSockAddEvents(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockLazy(mFS.Addr(), "ClueCon", 1,
+		map[string][]func(string, int){"HEARTBEAT": {func(string, int) {}}}, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.AddEvents("CHANNEL_ANSWER"); err != nil { // subscribed on connect
+		t.Fatal(err)
+	}
+	if err = fs.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if err = fs.AddEvents("HEARTBEAT", "CHANNEL_ANSWER", "CHANNEL_HANGUP", "DTMF"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.AddEvents("DTMF"); err != nil { // nothing new to send
+		t.Fatal(err)
+	}
+	expected := []string{
+		"auth ClueCon\n",
+		"event plain CHANNEL_ANSWER HEARTBEAT\n",
+		"event plain CHANNEL_HANGUP DTMF\n",
+	}
+	if cmds := mFS.Cmds(); !reflect.DeepEqual(expected, cmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, cmds)
+	}
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if cmds, exp := mFS.Cmds(), "event plain CHANNEL_ANSWER CHANNEL_HANGUP DTMF HEARTBEAT\n"; cmds[len(cmds)-1] != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmds[len(cmds)-1])
+	}
+}
+
+func TestFSockSetEvents(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1,
+		map[string][]func(string, int){"HEARTBEAT": {func(string, int) {}}}, nil, nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if err = fs.AddEvents("CHANNEL_ANSWER"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.SetEvents("DTMF"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"auth ClueCon\n",
+		"event plain HEARTBEAT BACKGROUND_JOB\n",
+		"event plain CHANNEL_ANSWER\n",
+		"noevents\n",
+		"event plain DTMF HEARTBEAT BACKGROUND_JOB\n",
+	}
+	if cmds := mFS.Cmds(); !reflect.DeepEqual(expected, cmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, cmds)
+	}
+	if err = fs.Reconnect(); err != nil {
+		t.Fatal(err)
+	}
+	if cmds, exp := mFS.Cmds(), "event plain DTMF HEARTBEAT BACKGROUND_JOB\n"; cmds[len(cmds)-1] != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmds[len(cmds)-1])
+	}
+}
+
+func TestFSockPoolDo(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	pool := NewFSockPool(1, mFS.Addr(), "ClueCon", 1, 10*time.Millisecond,
+		make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	expErr := errors.New("test error")
+	if err = pool.Do(func(fsk *FSock) error {
+		if _, err := fsk.SendApiCmd("status"); err != nil {
+			return err
+		}
+		return expErr
+	}); err != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	if len(pool.fSocks) != 1 {
+		t.Fatalf("\nExpected: <%+v>, \nReceived: <%+v>", 1, len(pool.fSocks))
+	}
+
+	func() {
+		defer func() {
+			if r := recover(); r != "buggy fn" {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", "buggy fn", r)
+			}
+		}()
+		pool.Do(func(*FSock) error { panic("buggy fn") })
+	}()
+	if len(pool.fSocks) != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, len(pool.fSocks))
+	}
+	if mFS.Accepted() != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, mFS.Accepted())
+	}
+
+	mFS.Close() // failed connects give back their slot
+	pool = NewFSockPool(1, mFS.Addr(), "ClueCon", 1, 10*time.Millisecond,
+		make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	for i := 0; i < 2; i++ {
+		if err = pool.Do(func(*FSock) error { return nil }); err == nil || err == ErrConnectionPoolTimeout {
+			t.Errorf("expected connection error, received: %v", err)
+		}
+	}
+}
+
+func TestFSockPoolSendApiCmd(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	pool := NewFSockPool(1, mFS.Addr(), "ClueCon", 1, 10*time.Millisecond,
+		make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	for i := 0; i < 2; i++ {
+		if rply, err := pool.SendApiCmd("status"); err != nil {
+			t.Fatal(err)
+		} else if rply != "+OK\n" {
+			t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+		}
+		if len(pool.fSocks) != 1 {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, len(pool.fSocks))
+		}
+	}
+	if mFS.Accepted() != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, mFS.Accepted())
+	}
+}
+
+func TestFSockPoolPinFSockForUUID(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	pool := NewFSockPool(2, mFS.Addr(), "ClueCon", 1, 10*time.Millisecond,
+		make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	pinned, err := pool.PinFSockForUUID("call-uuid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsk, err := pool.PinFSockForUUID("call-uuid"); err != nil {
+		t.Fatal(err)
+	} else if fsk != pinned {
+		t.Error("expected the same socket for the pinned uuid")
+	}
+	fsk, err := pool.PopFSock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsk == pinned {
+		t.Error("pinned socket returned by PopFSock")
+	}
+	if _, err := pool.PinFSockForUUID("other-uuid"); err != ErrConnectionPoolTimeout {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrConnectionPoolTimeout, err)
+	}
+	pool.PushFSock(fsk)
+	pool.UnpinFSock("call-uuid")
+	if len(pool.fSocks) != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, len(pool.fSocks))
+	}
+}
+
+func TestFSockSendBgapiCmdReplyJobUUID(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	go func() {
+		if _, err := readMockCmd(bufio.NewReader(fsConn)); err != nil {
+			return
+		}
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK Job-UUID: fs-job-uuid\nJob-UUID: fs-job-uuid\n\n"))
+	}()
+	out, err := fs.SendBgapiCmd("status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := "Event-Name: BACKGROUND_JOB\nJob-UUID: fs-job-uuid\nContent-Length: 4\n\n+OK\n"
+	fmt.Fprintf(fsConn, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)
+	select {
+	case rply := <-out:
+		if rply != "+OK\n" {
+			t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n", rply)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("background job reply not received")
+	}
+}
+
+func TestFSockConnectIPv6(t *testing.T) {
+	mFS, err := newMockFSOn("[::1]:0", "ClueCon")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	defer mFS.Close()
+	_, port, _ := net.SplitHostPort(mFS.Addr())
+	for _, addr := range []string{mFS.Addr(), "tcp://[::1]:" + port} {
+		fs, err := NewFSock(addr, "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+		if err != nil {
+			t.Fatalf("<%s>: %v", addr, err)
+		}
+		if _, err = fs.SendApiCmd("status"); err != nil {
+			t.Errorf("<%s>: %v", addr, err)
+		}
+		fs.Disconnect()
+	}
+	if mFS.Accepted() != 2 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 2, mFS.Accepted())
+	}
+}
+
+func TestFSockExecuteAppSeq(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	apps := []AppCmd{
+		{Name: "answer"},
+		{Name: "playback", Args: "/tmp/welcome.wav"},
+		{Name: "record", Args: "/tmp/msg.wav 30"},
+	}
+	cmds := make(chan map[string]string, len(apps))
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for i := range apps {
+			cmd, err := readMockCmd(rdr)
+			if err != nil {
+				return
+			}
+			cmds <- FSEventStrToMap(cmd, nil)
+			// the next command is sent only after the reply
+			fsConn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+			if _, err = rdr.Peek(1); err == nil {
+				t.Errorf("command sent before the reply of %s", apps[i].Name)
+			}
+			fsConn.SetReadDeadline(time.Time{})
+			fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+		}
+	}()
+	if err := fs.ExecuteAppSeq("3d9bcd1f", apps); err != nil {
+		t.Fatal(err)
+	}
+	for _, app := range apps {
+		expected := map[string]string{
+			"call-command":     "execute",
+			"execute-app-name": app.Name,
+			"event-lock":       "true",
+		}
+		if len(app.Args) != 0 {
+			expected["execute-app-arg"] = app.Args
+		}
+		if cmd := <-cmds; !reflect.DeepEqual(expected, cmd) {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, cmd)
+		}
+	}
+}
+
+func TestFSockConnectRudeRejection(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("Content-Type: text/rude-rejection\nContent-Length: 24\n\nAccess Denied, go away.\n"))
+	}()
+	if _, err = NewFSock(l.Addr().String(), "ClueCon", 1, nil, nil, nil, 0, true); err != ErrAccessDenied {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrAccessDenied, err)
+	}
+}
+
+func TestFSockSetCmdTimeout(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	go func() { // read the commands but never reply
+		rdr := bufio.NewReader(fsConn)
+		for {
+			if _, err := readMockCmd(rdr); err != nil {
+				return
+			}
+		}
+	}()
+	fs.SetCmdTimeout(20 * time.Millisecond)
+	start := time.Now()
+	if _, err := fs.SendApiCmd("status"); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	if err := fs.SendMsgCmd("3d9bcd1f", map[string]string{"call-command": "hangup"}); err != context.DeadlineExceeded {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", context.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("commands waited for %v", elapsed)
+	}
+}
+
+func TestFSockReadEventsRestart(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	for i := 0; i < 2; i++ {
+		readDone := make(chan error, 1)
+		go func() { readDone <- fs.ReadEvents() }()
+		select {
+		case err = <-readDone:
+			t.Fatalf("ReadEvents %d returned early with: %v", i, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+		if _, err = fs.SendApiCmd("status"); err != nil {
+			t.Error(err)
+		}
+		fs.Close()
+		select {
+		case err = <-readDone:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("ReadEvents %d not returning on Close", i)
+		}
+		if err = fs.ReadEvents(); err != nil { // returns right away while closed
+			t.Error(err)
+		}
+		if err = fs.Reconnect(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if accepted := mFS.Accepted(); accepted != 3 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 3, accepted)
+	}
+}
+
+func TestFSockCloseWait(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readDone := make(chan error, 1)
+	go func() { readDone <- fs.ReadEvents() }()
+
+	started := make(chan struct{})
+	var finished int32
+	fs.eventHandlers["HEARTBEAT"] = []func(string, int){func(string, int) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+	}}
+	fs.dispatchEvent("Event-Name: HEARTBEAT\n")
+	<-started
+	if err = fs.CloseWait(time.Second); err != nil {
+		t.Error(err)
+	}
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("CloseWait returned before the handler finished")
+	}
+	if fs.Connected() {
+		t.Error("expected disconnected")
+	}
+	select {
+	case err := <-readDone:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("ReadEvents not returning on Close")
+	}
+
+	block := make(chan struct{})
+	defer close(block)
+	fs.eventHandlers["HEARTBEAT"] = []func(string, int){func(string, int) { <-block }}
+	fs.dispatchEvent("Event-Name: HEARTBEAT\n")
+	expErr := "Timeout waiting for the event handlers to finish"
+	if err = fs.CloseWait(10 * time.Millisecond); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockCloseWaitSlowSynchronousHandler(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	ev := "Event-Name: HEARTBEAT\n"
+	mFS.SetReply("api heartbeat", fmt.Sprintf("Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)+
+		"Content-Type: api/response\nContent-Length: 4\n\n+OK\n")
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	fs, err := NewFSockFromConfig(Config{
+		Address:             mFS.Addr(),
+		Password:            "ClueCon",
+		CmdTimeout:          time.Second,
+		SynchronousDispatch: true,
+		EventHandlers: map[string][]func(string, int){"HEARTBEAT": {func(string, int) {
+			close(started)
+			<-release // holds the dispatching
+		}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go fs.SendApiCmd("heartbeat")
+	<-started
+	start := time.Now()
+	expErr := "Timeout waiting for the event handlers to finish"
+	if err = fs.CloseWait(50 * time.Millisecond); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+	if waited := time.Since(start); waited > 500*time.Millisecond {
+		t.Errorf("CloseWait blocked for %v past its timeout", waited)
+	}
+	if !fs.isClosed() || fs.Connected() {
+		t.Error("expected closed and disconnected")
+	}
+}
+
+func TestFSockClosedNoReconnect(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1, nil, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Close()
+	if _, err = fs.SendApiCmd("status"); err != ErrClosed {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", ErrClosed, err)
+	}
+	if accepted := mFS.Accepted(); accepted != 1 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 1, accepted)
+	}
+	if err = fs.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if _, err = fs.SendApiCmd("status"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSockConnectCustomSubclass(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSock(mFS.Addr(), "ClueCon", 1,
+		map[string][]func(string, int){"CUSTOM sofia::register": {func(string, int) {}}}, nil, nil, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if err = fs.AddEventHandler("CUSTOM conference::maintenance", func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.AddEventHandler("HEARTBEAT", func(string, int) {}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"auth ClueCon\n",
+		"event plain CUSTOM sofia::register\n",
+		"event plain CUSTOM conference::maintenance\n",
+		"event plain HEARTBEAT\n",
+	}
+	if cmds := mFS.Cmds(); !reflect.DeepEqual(expected, cmds) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, cmds)
+	}
+	if cmd, exp := eventsPlainCmd([]string{"CUSTOM sofia::register", "HEARTBEAT", "CUSTOM sofia::expire"}, true),
+		"event plain HEARTBEAT BACKGROUND_JOB CUSTOM sofia::register sofia::expire"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+	if cmd, exp := eventsPlainCmd([]string{"CUSTOM", "HEARTBEAT"}, false), "event plain HEARTBEAT CUSTOM"; cmd != exp {
+		t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+	}
+}
+
+func TestFSockreadEventMixedCaseContentLength(t *testing.T) {
+	fs := &FSock{
+		buffer:  bufio.NewReader(bytes.NewBufferString("Content-length: 5\ncontent-type: api/response\n\n+OK\n\n")),
+		logger:  nopLogger{},
+		fsMutex: new(sync.RWMutex),
+	}
+	if _, body, err := fs.readEvent(); err != nil {
+		t.Error(err)
+	} else if body != "+OK\n\n" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "+OK\n\n", body)
+	}
+}
+
+func TestFSockSetWriteTimeout(t *testing.T) {
+	fs, fsConn := newPipeFSock() // nothing reads from fsConn so writes block
+	defer fsConn.Close()
+	fs.SetWriteTimeout(20 * time.Millisecond)
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := fs.SendApiCmd("status")
+		errChan <- err
+	}()
+	select {
+	case err := <-errChan:
+		if netErr, isNetErr := err.(net.Error); !isNetErr || !netErr.Timeout() {
+			t.Errorf("expected timeout error, received: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write not timing out")
+	}
+	if fs.Connected() {
+		t.Error("expected disconnected after the write timeout")
+	}
+}
+
+func TestFSockSetWriteTimeoutCleared(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockFromConfig(Config{Address: mFS.Addr(), Password: "ClueCon", WriteTimeout: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if _, err = fs.SendApiCmd("status"); err != nil {
+		t.Fatal(err)
+	}
+	fs.SetWriteTimeout(0)
+	time.Sleep(40 * time.Millisecond) // past the deadline of the previous write
+	if _, err = fs.SendApiCmd("status"); err != nil {
+		t.Errorf("expected the write deadline cleared, received: %v", err)
+	}
+}
+
+func TestFSockActiveChannels(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	showChannels := "uuid,direction,created,created_epoch,name,state,cid_name,cid_num,ip_addr,dest,application,application_data,dialplan,context,read_codec,read_rate,read_bit_rate,write_codec,write_rate,write_bit_rate,secure,hostname,presence_id,presence_data,callstate,callee_name,callee_num,callee_direction,call_uuid,sent_callee_name,sent_callee_num\n" +
+		"c56125cc-024a-48a2-adbc-9612f6c02334,outbound,2014-10-26 18:08:32,1414343312,sofia/ipbxas/dan@172.16.254.66,CS_EXCHANGE_MEDIA,dan,+4986517174963,172.16.254.66,dan,playback,local_stream://moh,XML,ipbxas,PCMA,8000,64000,PCMA,8000,64000,,iPBXDev,dan@172.16.254.66,,ACTIVE,Outbound Call,dan,,fed464b3-a328-453f-9437-92b9b6a400fd,,\n" +
+		"\n1 total.\n"
+	go func() {
+		cmd, err := readMockCmd(bufio.NewReader(fsConn))
+		if err != nil {
+			return
+		}
+		if exp := "api show channels\n"; cmd != exp {
+			t.Errorf("\nExpected: %q, \nReceived: %q", exp, cmd)
+		}
+		fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(showChannels), showChannels)
+	}()
+	chans, err := fs.ActiveChannels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ChannelInfo{{
+		UUID:            "c56125cc-024a-48a2-adbc-9612f6c02334",
+		Direction:       "outbound",
+		Created:         "2014-10-26 18:08:32",
+		CreatedEpoch:    1414343312,
+		Name:            "sofia/ipbxas/dan@172.16.254.66",
+		State:           "CS_EXCHANGE_MEDIA",
+		CIDName:         "dan",
+		CIDNum:          "+4986517174963",
+		IPAddr:          "172.16.254.66",
+		Dest:            "dan",
+		Application:     "playback",
+		ApplicationData: "local_stream://moh",
+		Context:         "ipbxas",
+		ReadCodec:       "PCMA",
+		WriteCodec:      "PCMA",
+		Hostname:        "iPBXDev",
+		CallState:       "ACTIVE",
+		CalleeName:      "Outbound Call",
+		CalleeNum:       "dan",
+		CallUUID:        "fed464b3-a328-453f-9437-92b9b6a400fd",
+		Extra: map[string]string{
+			"dialplan":         "XML",
+			"read_rate":        "8000",
+			"read_bit_rate":    "64000",
+			"write_rate":       "8000",
+			"write_bit_rate":   "64000",
+			"secure":           "",
+			"presence_id":      "dan@172.16.254.66",
+			"presence_data":    "",
+			"callee_direction": "",
+			"sent_callee_name": "",
+			"sent_callee_num":  "",
+		},
+	}}
+	if !reflect.DeepEqual(expected, chans) {
+		t.Errorf("\nExpected: %+v, \nReceived: %+v", expected, chans)
+	}
+}
+
+func TestFSockFindChannels(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	showChannels := "uuid,direction,cid_name,cid_num,context\n" +
+		"uuid1,inbound,dan,1001,account1\n" +
+		"uuid2,outbound,dan,1002,account1\n" +
+		"uuid3,inbound,ana,1001,account2\n" +
+		"\n3 total.\n"
+	go func() {
+		rdr := bufio.NewReader(fsConn)
+		for {
+			if _, err := readMockCmd(rdr); err != nil {
+				return
+			}
+			fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n%s", len(showChannels), showChannels)
+		}
+	}()
+	for _, tc := range []struct {
+		match map[string]string
+		uuids []string
+	}{
+		{match: map[string]string{"cid_num": "1001"}, uuids: []string{"uuid1", "uuid3"}},
+		{match: map[string]string{"cid_num": "1001", "context": "account1"}, uuids: []string{"uuid1"}},
+		{match: map[string]string{"cid_num": "100"}, uuids: []string{}},
+		{match: map[string]string{"missing_col": ""}, uuids: []string{}},
+		{uuids: []string{"uuid1", "uuid2", "uuid3"}},
+	} {
+		chans, err := fs.FindChannels(tc.match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uuids := make([]string, len(chans))
+		for i, chInfo := range chans {
+			uuids[i] = chInfo.UUID
+		}
+		if !reflect.DeepEqual(tc.uuids, uuids) {
+			t.Errorf("match %+v\nExpected: <%+v>, \nReceived: <%+v>", tc.match, tc.uuids, uuids)
+		}
+	}
+}
+
+func TestFSockSetLocalAddr(t *testing.T) {
+	mFS, err := newMockFS("ClueCon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mFS.Close()
+	fs, err := NewFSockLazy(mFS.Addr(), "ClueCon", 1, make(map[string][]func(string, int)), make(map[string][]string), nil, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.SetLocalAddr("127.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Disconnect()
+	if remotes := mFS.Remotes(); len(remotes) != 1 || !strings.HasPrefix(remotes[0], "127.0.0.2:") {
+		t.Errorf("unexpected remote addresses: %q", remotes)
+	}
+	expErr := "Invalid local address <not an ip:0>: "
+	if err = fs.SetLocalAddr("not an ip"); err == nil || !strings.HasPrefix(err.Error(), expErr) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+}
+
+func TestFSockSetVarURLEncoding(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	value := "line1\nline2: 100% +ok"
+	expErr := "Invalid value of sendmsg header <execute-app-arg>: new lines need URL-encoding"
+	if err := fs.SetVar("3d9bcd1f", "notes", value); err == nil || err.Error() != expErr {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expErr, err)
+	}
+
+	fs.SetMsgURLEncoding(true)
+	cmds := make(chan string, 1)
+	go func() {
+		cmd, err := readMockCmd(bufio.NewReader(fsConn))
+		if err != nil {
+			return
+		}
+		cmds <- cmd
+		fsConn.Write([]byte("Content-Type: command/reply\nReply-Text: +OK\n\n"))
+	}()
+	if err := fs.SetVar("3d9bcd1f", "notes", value); err != nil {
+		t.Fatal(err)
+	}
+	cmdMap := FSEventStrToMap(<-cmds, nil) // decodes the values as FreeSWITCH
+	expected := map[string]string{
+		"call-command":     "execute",
+		"execute-app-name": "set",
+		"execute-app-arg":  "notes=" + value,
+	}
+	if !reflect.DeepEqual(expected, cmdMap) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, cmdMap)
+	}
+}
+
+func TestFSockRecentFrames(t *testing.T) {
+	var frames bytes.Buffer
+	for i := 0; i < 4; i++ {
+		ev := fmt.Sprintf("Event-Name: HEARTBEAT\nEvent-Sequence: %d\n", i)
+		fmt.Fprintf(&frames, "Content-Length: %d\nContent-Type: text/event-plain\n\n%s", len(ev), ev)
+	}
+	frames.WriteString("Content-Length: bad\n\n")
+	fs := &FSock{
+		buffer:  bufio.NewReader(&frames),
+		logger:  nopLogger{},
+		fsMutex: new(sync.RWMutex),
+	}
+	if _, _, err := fs.readEvent(); err != nil {
+		t.Fatal(err)
+	}
+	if rcv := fs.RecentFrames(); len(rcv) != 0 {
+		t.Errorf("expected no frames kept while disabled, received: %+v", rcv)
+	}
+	fs.SetFrameHistory(2)
+	for i := 0; i < 4; i++ {
+		fs.readEvent()
+	}
+	expected := []RawFrame{
+		{
+			Header: "Content-Length: 40\nContent-Type: text/event-plain\n",
+			Body:   "Event-Name: HEARTBEAT\nEvent-Sequence: 3\n",
+		},
+		{Header: "Content-Length: bad\n"},
+	}
+	if rcv := fs.RecentFrames(); !reflect.DeepEqual(expected, rcv) {
+		t.Errorf("\nExpected: %+v, \nReceived: %+v", expected, rcv)
+	}
+	fs.SetFrameHistory(1)
+	if rcv := fs.RecentFrames(); !reflect.DeepEqual(expected[1:], rcv) {
+		t.Errorf("\nExpected: %+v, \nReceived: %+v", expected[1:], rcv)
+	}
+}
+
+func TestFSockUndispatchedEvents(t *testing.T) {
+	fs := &FSock{fsMutex: new(sync.RWMutex), logger: nopLogger{}}
+	fs.SetSynchronousDispatch(true)
+	fs.AddEventHandler("HEARTBEAT", func(string, int) {})
+	fs.SetUndispatchedHistory(2)
+	for i, evName := range []string{"CHANNEL_ANSWER", "HEARTBEAT", "CHANNEL_HANGUP", "RE_SCHEDULE"} {
+		fs.dispatchEvent(fmt.Sprintf("Event-Name: %s\nEvent-Date-Timestamp: %d\n", evName, 1678789230000000+i))
+	}
+	dead := fs.UndispatchedEvents()
+	var names []string
+	for _, ev := range dead {
+		names = append(names, ev.Name)
+	}
+	if expected := []string{"CHANNEL_HANGUP", "RE_SCHEDULE"}; !reflect.DeepEqual(expected, names) {
+		t.Fatalf("\nExpected: %q, \nReceived: %q", expected, names)
+	}
+	if tm, err := dead[1].Timestamp(); err != nil || tm.UnixNano() != 1678789230000003000 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v> %v", 1678789230000003000, tm.UnixNano(), err)
+	}
+	fs.SetUndispatchedHistory(0)
+	fs.dispatchEvent("Event-Name: CHANNEL_ANSWER\n")
+	if dead := fs.UndispatchedEvents(); len(dead) != 0 {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", 0, len(dead))
+	}
+}
+
+func TestFSockSendApiCmdBytes(t *testing.T) {
+	fs, fsConn := newPipeFSock()
+	defer fsConn.Close()
+	body := []byte{0x00, 0xff, 0xfe, '\r', '\n', '\n', 0x80, 'O', 'K', 0x1b, '\r'}
+	go func() {
+		if _, err := readMockCmd(bufio.NewReader(fsConn)); err != nil {
+			return
+		}
+		fmt.Fprintf(fsConn, "Content-Type: api/response\nContent-Length: %d\n\n", len(body))
+		fsConn.Write(body)
+	}()
+	if rply, err := fs.SendApiCmdBytes("fsctl debug_dump"); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(body, rply) {
+		t.Errorf("\nExpected: %q, \nReceived: %q", body, rply)
+	}
+}
+
+/*********************** Benchmarks ************************/
+
+func BenchmarkReadBody(b *testing.B) {
+	body := "Event-Name: CHANNEL_DATA\nUnique-ID: 0b28a8a4-3c6e-4a43-9b1f-1b7c5bc3a5ba\nChannel-State: CS_EXECUTE\n\n"
+	input := bytes.Repeat([]byte(body), 1000)
+	rdr := bytes.NewReader(input)
+	fs := &FSock{
+		fsMutex: &sync.RWMutex{},
+		logger:  nopLogger{},
+		buffer:  bufio.NewReader(rdr),
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if i%1000 == 0 {
+			rdr.Reset(input)
+			fs.buffer.Reset(rdr)
+		}
+		if _, err := fs.readBody(len(body)); err != nil {
+			b.Fatal(err)
+		}
+	}
 }
@@ -12,15 +12,102 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/url"
+	"os"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
-const EventBodyTag = "EvBody"
+const (
+	EventBodyTag = "EvBody"
 
-type logger interface {
+	DefaultFSPort = "8021" // Port FreeSWITCH event socket listens on by default
+)
+
+// KnownEventNames are the event names of FreeSWITCH, used to warn about misspelled subscriptions
+// Extend it with the names of the newer FreeSWITCH versions if needed
+var KnownEventNames = map[string]bool{
+	"CUSTOM": true, "CLONE": true, "CHANNEL_CREATE": true, "CHANNEL_DESTROY": true, "CHANNEL_STATE": true,
+	"CHANNEL_CALLSTATE": true, "CHANNEL_ANSWER": true, "CHANNEL_HANGUP": true, "CHANNEL_HANGUP_COMPLETE": true,
+	"CHANNEL_EXECUTE": true, "CHANNEL_EXECUTE_COMPLETE": true, "CHANNEL_HOLD": true, "CHANNEL_UNHOLD": true,
+	"CHANNEL_BRIDGE": true, "CHANNEL_UNBRIDGE": true, "CHANNEL_PROGRESS": true, "CHANNEL_PROGRESS_MEDIA": true,
+	"CHANNEL_OUTGOING": true, "CHANNEL_PARK": true, "CHANNEL_UNPARK": true, "CHANNEL_APPLICATION": true,
+	"CHANNEL_ORIGINATE": true, "CHANNEL_UUID": true, "API": true, "LOG": true, "INBOUND_CHAN": true,
+	"OUTBOUND_CHAN": true, "STARTUP": true, "SHUTDOWN": true, "PUBLISH": true, "UNPUBLISH": true, "TALK": true,
+	"NOTALK": true, "SESSION_CRASH": true, "MODULE_LOAD": true, "MODULE_UNLOAD": true, "DTMF": true,
+	"MESSAGE": true, "PRESENCE_IN": true, "NOTIFY_IN": true, "PRESENCE_OUT": true, "PRESENCE_PROBE": true,
+	"MESSAGE_WAITING": true, "MESSAGE_QUERY": true, "ROSTER": true, "CODEC": true, "BACKGROUND_JOB": true,
+	"DETECTED_SPEECH": true, "DETECTED_TONE": true, "PRIVATE_COMMAND": true, "HEARTBEAT": true, "TRAP": true,
+	"ADD_SCHEDULE": true, "DEL_SCHEDULE": true, "EXE_SCHEDULE": true, "RE_SCHEDULE": true, "RELOADXML": true,
+	"NOTIFY": true, "PHONE_FEATURE": true, "PHONE_FEATURE_SUBSCRIBE": true, "SEND_MESSAGE": true,
+	"RECV_MESSAGE": true, "REQUEST_PARAMS": true, "CHANNEL_DATA": true, "GENERAL": true, "COMMAND": true,
+	"SESSION_HEARTBEAT": true, "CLIENT_DISCONNECTED": true, "SERVER_DISCONNECTED": true, "SEND_INFO": true,
+	"RECV_INFO": true, "RECV_RTCP_MESSAGE": true, "SEND_RTCP_MESSAGE": true, "CALL_SECURE": true, "NAT": true,
+	"RECORD_START": true, "RECORD_STOP": true, "PLAYBACK_START": true, "PLAYBACK_STOP": true,
+	"CALL_UPDATE": true, "FAILURE": true, "SOCKET_DATA": true, "MEDIA_BUG_START": true, "MEDIA_BUG_STOP": true,
+	"CONFERENCE_DATA_QUERY": true, "CONFERENCE_DATA": true, "CALL_SETUP_REQ": true, "CALL_SETUP_RESULT": true,
+	"CALL_DETAIL": true, "DEVICE_STATE": true, "TEXT": true, "SHUTDOWN_REQUESTED": true, "ALL": true,
+}
+
+// unknownEventNames returns the event names missing from KnownEventNames
+// The CUSTOM subclasses and the wildcards are not checked
+func unknownEventNames(events []string) (unknown []string) {
+	for _, ev := range events {
+		if strings.HasSuffix(ev, "*") || strings.HasPrefix(ev, "CUSTOM ") {
+			continue
+		}
+		if !KnownEventNames[ev] {
+			unknown = append(unknown, ev)
+		}
+	}
+	return
+}
+
+// expandWildcards replaces the wildcards with the KnownEventNames they match, keeping the other events
+// The wildcards matching the CUSTOM subclasses, or no known name, are replaced with ALL since their names cannot be listed
+func expandWildcards(events []string) (expanded []string) {
+	listed := make(map[string]bool)
+	add := func(ev string) {
+		if !listed[ev] {
+			listed[ev] = true
+			expanded = append(expanded, ev)
+		}
+	}
+	for _, ev := range events {
+		if !strings.HasSuffix(ev, "*") {
+			add(ev)
+			continue
+		}
+		prefix := ev[:len(ev)-1]
+		if strings.HasPrefix("CUSTOM ", prefix) || strings.HasPrefix(prefix, "CUSTOM") {
+			add("ALL")
+			continue
+		}
+		var matched []string
+		for name := range KnownEventNames {
+			if name != "ALL" && strings.HasPrefix(name, prefix) {
+				matched = append(matched, name)
+			}
+		}
+		if len(matched) == 0 {
+			add("ALL")
+			continue
+		}
+		sort.Strings(matched)
+		for _, name := range matched {
+			add(name)
+		}
+	}
+	return
+}
+
+// Logger is the logging interface used by FSock, implemented by *syslog.Writer and StdLogger
+type Logger interface {
 	Alert(string) error
 	Close() error
 	Crit(string) error
@@ -43,21 +130,153 @@ func (nopLogger) Info(string) error    { return nil }
 func (nopLogger) Notice(string) error  { return nil }
 func (nopLogger) Warning(string) error { return nil }
 
+// labeledLogger appends the labels of the socket to the messages
+type labeledLogger struct {
+	Logger
+	fs *FSock
+}
+
+func (ll labeledLogger) Alert(msg string) error   { return ll.Logger.Alert(ll.fs.labeled(msg)) }
+func (ll labeledLogger) Crit(msg string) error    { return ll.Logger.Crit(ll.fs.labeled(msg)) }
+func (ll labeledLogger) Debug(msg string) error   { return ll.Logger.Debug(ll.fs.labeled(msg)) }
+func (ll labeledLogger) Emerg(msg string) error   { return ll.Logger.Emerg(ll.fs.labeled(msg)) }
+func (ll labeledLogger) Err(msg string) error     { return ll.Logger.Err(ll.fs.labeled(msg)) }
+func (ll labeledLogger) Info(msg string) error    { return ll.Logger.Info(ll.fs.labeled(msg)) }
+func (ll labeledLogger) Notice(msg string) error  { return ll.Logger.Notice(ll.fs.labeled(msg)) }
+func (ll labeledLogger) Warning(msg string) error { return ll.Logger.Warning(ll.fs.labeled(msg)) }
+
+// dynLogger forwards to the Logger returned by the function, so it can be replaced while in use
+type dynLogger func() Logger
+
+func (dl dynLogger) Alert(msg string) error   { return dl().Alert(msg) }
+func (dl dynLogger) Close() error             { return dl().Close() }
+func (dl dynLogger) Crit(msg string) error    { return dl().Crit(msg) }
+func (dl dynLogger) Debug(msg string) error   { return dl().Debug(msg) }
+func (dl dynLogger) Emerg(msg string) error   { return dl().Emerg(msg) }
+func (dl dynLogger) Err(msg string) error     { return dl().Err(msg) }
+func (dl dynLogger) Info(msg string) error    { return dl().Info(msg) }
+func (dl dynLogger) Notice(msg string) error  { return dl().Notice(msg) }
+func (dl dynLogger) Warning(msg string) error { return dl().Warning(msg) }
+
+// StdLogger is a Logger writing through the standard log package, for systems without syslog
+type StdLogger struct {
+	logger *log.Logger
+}
+
+// NewStdLogger returns a StdLogger writing to l, to stderr if l is nil
+func NewStdLogger(l *log.Logger) *StdLogger {
+	if l == nil {
+		l = log.New(os.Stderr, "", log.LstdFlags)
+	}
+	return &StdLogger{logger: l}
+}
+
+func (sl *StdLogger) output(lvl, msg string) error {
+	return sl.logger.Output(3, "["+lvl+"] "+msg)
+}
+
+func (sl *StdLogger) Alert(msg string) error   { return sl.output("ALERT", msg) }
+func (sl *StdLogger) Close() error             { return nil }
+func (sl *StdLogger) Crit(msg string) error    { return sl.output("CRIT", msg) }
+func (sl *StdLogger) Debug(msg string) error   { return sl.output("DEBUG", msg) }
+func (sl *StdLogger) Emerg(msg string) error   { return sl.output("EMERG", msg) }
+func (sl *StdLogger) Err(msg string) error     { return sl.output("ERR", msg) }
+func (sl *StdLogger) Info(msg string) error    { return sl.output("INFO", msg) }
+func (sl *StdLogger) Notice(msg string) error  { return sl.output("NOTICE", msg) }
+func (sl *StdLogger) Warning(msg string) error { return sl.output("WARNING", msg) }
+
 // Convert fseventStr into fseventMap
 func FSEventStrToMap(fsevstr string, headers []string) map[string]string {
 	fsevent := make(map[string]string)
 	filtered := (len(headers) != 0)
 	for _, strLn := range strings.Split(fsevstr, "\n") {
-		if hdrVal := strings.SplitN(strLn, ": ", 2); len(hdrVal) == 2 {
-			if filtered && isSliceMember(headers, hdrVal[0]) {
+		if hdr, val, ok := parseHeaderLine(strLn); ok && hdr != "" {
+			if filtered && isSliceMember(headers, hdr) {
 				continue // Loop again since we only work on filtered fields
 			}
-			fsevent[hdrVal[0]] = urlDecode(strings.TrimSpace(strings.TrimRight(hdrVal[1], "\n")))
+			fsevent[hdr] = urlDecode(val)
 		}
 	}
 	return fsevent
 }
 
+// ChannelInfo is a channel as listed by the show channels API command
+type ChannelInfo struct {
+	UUID            string
+	Direction       string
+	Created         string
+	CreatedEpoch    int64
+	Name            string
+	State           string
+	CIDName         string
+	CIDNum          string
+	IPAddr          string
+	Dest            string
+	Application     string
+	ApplicationData string
+	Context         string
+	ReadCodec       string
+	WriteCodec      string
+	Hostname        string
+	CallState       string
+	CalleeName      string
+	CalleeNum       string
+	CallUUID        string
+	Extra           map[string]string // The columns without a field above
+}
+
+// newChannelInfo maps the columns returned by MapChanData to the ChannelInfo fields
+func newChannelInfo(chnMp map[string]string) (chInfo ChannelInfo) {
+	chInfo.Extra = make(map[string]string)
+	for col, val := range chnMp {
+		switch col {
+		case "uuid":
+			chInfo.UUID = val
+		case "direction":
+			chInfo.Direction = val
+		case "created":
+			chInfo.Created = val
+		case "created_epoch":
+			chInfo.CreatedEpoch, _ = strconv.ParseInt(val, 10, 64)
+		case "name":
+			chInfo.Name = val
+		case "state":
+			chInfo.State = val
+		case "cid_name":
+			chInfo.CIDName = val
+		case "cid_num":
+			chInfo.CIDNum = val
+		case "ip_addr":
+			chInfo.IPAddr = val
+		case "dest":
+			chInfo.Dest = val
+		case "application":
+			chInfo.Application = val
+		case "application_data":
+			chInfo.ApplicationData = val
+		case "context":
+			chInfo.Context = val
+		case "read_codec":
+			chInfo.ReadCodec = val
+		case "write_codec":
+			chInfo.WriteCodec = val
+		case "hostname":
+			chInfo.Hostname = val
+		case "callstate":
+			chInfo.CallState = val
+		case "callee_name":
+			chInfo.CalleeName = val
+		case "callee_num":
+			chInfo.CalleeNum = val
+		case "call_uuid":
+			chInfo.CallUUID = val
+		default:
+			chInfo.Extra[col] = val
+		}
+	}
+	return
+}
+
 // Converts string received from fsock into a list of channel info, each represented in a map
 func MapChanData(chanInfoStr string) (chansInfoMap []map[string]string) {
 	chansInfoMap = make([]map[string]string, 0)
@@ -80,6 +299,54 @@ func MapChanData(chanInfoStr string) (chansInfoMap []map[string]string) {
 	return
 }
 
+// ParseFSTable converts the tables returned by API commands like sofia status into a list of rows, each represented in a map
+// The table header is the line above the first ==== separator and the columns are separated by tabs
+func ParseFSTable(body string) (rows []map[string]string) {
+	rows = make([]map[string]string, 0)
+	lines := strings.Split(body, "\n")
+	var hdrs []string
+	for i, line := range lines {
+		if isTableSeparator(line) {
+			if hdrs != nil { // end of table
+				return
+			}
+			if i == 0 {
+				return // no header line
+			}
+			hdrs = splitTableLine(lines[i-1])
+			continue
+		}
+		if hdrs == nil {
+			continue
+		}
+		vals := splitTableLine(line)
+		if len(vals) != len(hdrs) {
+			continue
+		}
+		row := make(map[string]string)
+		for iHdr, hdr := range hdrs {
+			row[hdr] = vals[iHdr]
+		}
+		rows = append(rows, row)
+	}
+	return
+}
+
+// isTableSeparator checks if the line is made only of = characters
+func isTableSeparator(line string) bool {
+	line = strings.TrimSpace(line)
+	return len(line) != 0 && strings.Trim(line, "=") == ""
+}
+
+// splitTableLine splits the table line on tabs, trimming the padding of the columns
+func splitTableLine(line string) (cols []string) {
+	cols = strings.Split(line, "\t")
+	for i, col := range cols {
+		cols[i] = strings.TrimSpace(col)
+	}
+	return
+}
+
 func EventToMap(event string) (result map[string]string) {
 	result = make(map[string]string)
 	body := false
@@ -93,13 +360,54 @@ func EventToMap(event string) (result map[string]string) {
 			result[EventBodyTag] = strings.Join(spltevent[i:], "\n")
 			return
 		}
-		if val := strings.SplitN(spltevent[i], ": ", 2); len(val) == 2 {
-			result[val[0]] = urlDecode(strings.TrimSpace(val[1]))
+		if hdr, val, ok := parseHeaderLine(spltevent[i]); ok && hdr != "" {
+			result[hdr] = urlDecode(val)
 		}
 	}
 	return
 }
 
+// DecodeLatin1 converts the ISO-8859-1 encoded string to UTF-8, usable as charset decoder with SetCharsetDecoder
+// Every byte is taken as Latin-1, so the values already in UTF-8 must not be passed to it
+func DecodeLatin1(s string) string {
+	runes := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		runes[i] = rune(s[i])
+	}
+	return string(runes)
+}
+
+// decodeCharset applies the decoder to the values of the headers, to all headers and to the body if none listed
+func decodeCharset(event string, decode func(string) string, headers []string) string {
+	ev := NewEvent(event)
+	if len(headers) == 0 {
+		for hdr, val := range ev.Headers {
+			ev.Headers[hdr] = decode(val)
+		}
+		ev.Body = decode(ev.Body)
+		return ev.String()
+	}
+	for _, hdr := range headers {
+		if val, has := ev.Headers[hdr]; has {
+			ev.Headers[hdr] = decode(val)
+		}
+	}
+	return ev.String()
+}
+
+// parseJobUUID extracts the Job-UUID from a Reply-Text like "+OK Job-UUID: <uuid>", empty if missing
+func parseJobUUID(replyText string) string {
+	idx := strings.Index(replyText, "Job-UUID:")
+	if idx == -1 {
+		return ""
+	}
+	fields := strings.Fields(replyText[idx+len("Job-UUID:"):])
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[0]
+}
+
 // helper function for uuid generation
 func genUUID() string {
 	b := make([]byte, 16)
@@ -204,19 +512,51 @@ func splitIgnoreGroups(origStr, sep string) []string {
 	return groupedSplt
 }
 
-// Extracts value of a header from anywhere in content string
-func headerVal(hdrs, hdr string) string {
-	var hdrSIdx, hdrEIdx int
-	if hdrSIdx = strings.Index(hdrs, hdr); hdrSIdx == -1 {
-		return ""
-	} else if hdrEIdx = strings.Index(hdrs[hdrSIdx:], "\n"); hdrEIdx == -1 {
-		hdrEIdx = len(hdrs[hdrSIdx:])
+// parseHeaderLine splits the Key: Value line at the first colon, trimming the spaces and the \r of the CRLF endings
+// The value is returned as received, the url decoding is left to the functions mapping the event headers
+// ok is false for the lines without colon, the key being then the whole trimmed line
+func parseHeaderLine(line string) (key, value string, ok bool) {
+	idx := strings.IndexByte(line, ':')
+	if idx == -1 {
+		return strings.TrimSpace(line), "", false
 	}
-	splt := strings.SplitN(hdrs[hdrSIdx:hdrSIdx+hdrEIdx], ": ", 2)
-	if len(splt) != 2 {
-		return ""
+	return strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:]), true
+}
+
+// Extracts value of a header from the headers in content string
+// The value is not url decoded, the protocol headers it is used for are sent as they are
+func headerVal(hdrs, hdr string) (val string) {
+	val, _ = headerValue(hdrs, hdr)
+	return
+}
+
+// headerValue returns the value of the header and if it is present
+// The header names are matched case-insensitively, never inside values
+// The search stops at the empty line ending the headers
+func headerValue(hdrs, hdr string) (val string, has bool) {
+	for len(hdrs) != 0 {
+		line := hdrs
+		if idx := strings.IndexByte(hdrs, '\n'); idx != -1 {
+			line, hdrs = hdrs[:idx], hdrs[idx+1:]
+		} else {
+			hdrs = ""
+		}
+		if len(strings.TrimRight(line, "\r")) == 0 { // end of headers
+			return
+		}
+		name, value, _ := parseHeaderLine(line)
+		if len(name) >= len(hdr) &&
+			strings.EqualFold(name[len(name)-len(hdr):], hdr) &&
+			(len(name) == len(hdr) || name[len(name)-len(hdr)-1] == ' ') { // tolerate garbage in front of the name
+			return value, true
+		}
 	}
-	return strings.TrimSpace(strings.TrimRight(splt[1], "\n"))
+	return
+}
+
+// URLEncode escapes the header value so it can be sent to FreeSWITCH, reverse of the decoding applied to received headers
+func URLEncode(hdrVal string) string {
+	return strings.Replace(url.QueryEscape(hdrVal), "+", "%20", -1)
 }
 
 // FS event header values are urlencoded. Use this to decode them. On error, use original value
@@ -252,3 +592,48 @@ func fib() func() int {
 		return a
 	}
 }
+
+// cappedDelay returns the next delay of the sequence in seconds, limited to maxDelay unless 0
+func cappedDelay(delayFunc func() int, maxDelay time.Duration) (delay time.Duration) {
+	if delay = time.Duration(delayFunc()) * time.Second; maxDelay > 0 && delay > maxDelay {
+		delay = maxDelay
+	}
+	return
+}
+
+// parseFSAddress validates the FreeSWITCH address, returning the network and the address to dial
+// Accepted forms are host, host:port, tcp://host:port, tls://host:port and unix:///path/to/socket
+// The port defaults to DefaultFSPort when missing
+func parseFSAddress(fsaddr string) (network, address string, err error) {
+	network, address = "tcp", strings.TrimSpace(fsaddr)
+	if idx := strings.Index(address, "://"); idx != -1 {
+		network, address = strings.ToLower(address[:idx]), address[idx+3:]
+	}
+	if len(address) == 0 {
+		return "", "", fmt.Errorf("Invalid FreeSWITCH address <%s>: missing address", fsaddr)
+	}
+	switch network {
+	case "unix":
+		return
+	case "tcp", "tls":
+	default:
+		return "", "", fmt.Errorf("Invalid FreeSWITCH address <%s>: unsupported scheme <%s>", fsaddr, network)
+	}
+	host, port, errSplit := net.SplitHostPort(address)
+	if errSplit != nil { // try it as host only
+		host, port = address, DefaultFSPort
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") { // bracketed IPv6 literal
+			host = host[1 : len(host)-1]
+		}
+		if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+			return "", "", fmt.Errorf("Invalid FreeSWITCH address <%s>: %s", fsaddr, errSplit)
+		}
+	}
+	if len(host) == 0 || strings.ContainsAny(host, " /\t[]@?#") {
+		return "", "", fmt.Errorf("Invalid FreeSWITCH address <%s>: invalid host <%s>", fsaddr, host)
+	}
+	if prt, errPort := strconv.Atoi(port); errPort != nil || prt < 1 || prt > 65535 {
+		return "", "", fmt.Errorf("Invalid FreeSWITCH address <%s>: invalid port <%s>", fsaddr, port)
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
@@ -8,7 +8,10 @@ Provides FreeSWITCH socket communication.
 package fsock
 
 import (
+	"bytes"
 	"fmt"
+	"log"
+	"os"
 	"reflect"
 	"sort"
 	"strings"
@@ -376,6 +379,28 @@ func TestGetMapKeys(t *testing.T) {
 	}
 }
 
+func TestUtilsUnknownEventNames(t *testing.T) {
+	events := []string{"ALL", "CHANNEL_ANSWER", "CHANNEL_ANSWERED", "CUSTOM", "CUSTOM sofia::register",
+		"CHANNEL_*", "heartbeat", "BACKGROUND_JOB"}
+	expected := []string{"CHANNEL_ANSWERED", "heartbeat"}
+	if unknown := unknownEventNames(events); !reflect.DeepEqual(expected, unknown) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, unknown)
+	}
+}
+
+func TestUtilsExpandWildcards(t *testing.T) {
+	events := []string{"HEARTBEAT", "CHANNEL_HANGUP*", "CHANNEL_HANGUP", "CUSTOM sofia::register"}
+	expected := []string{"HEARTBEAT", "CHANNEL_HANGUP", "CHANNEL_HANGUP_COMPLETE", "CUSTOM sofia::register"}
+	if expanded := expandWildcards(events); !reflect.DeepEqual(expected, expanded) {
+		t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, expanded)
+	}
+	for _, wildcard := range []string{"*", "CUSTOM*", "CUSTOM sofia::*", "NO_SUCH_*"} {
+		if expanded := expandWildcards([]string{"DTMF", wildcard}); !reflect.DeepEqual([]string{"DTMF", "ALL"}, expanded) {
+			t.Errorf("%s: \nExpected: <%+v>, \nReceived: <%+v>", wildcard, []string{"DTMF", "ALL"}, expanded)
+		}
+	}
+}
+
 /*********************** Benchmarks ************************/
 
 func BenchmarkHeaderVal(b *testing.B) {
@@ -546,3 +571,189 @@ func TestUtilsgenUUID(t *testing.T) {
 		t.Error("GenUUID error.")
 	}
 }
+
+func TestUtilsParseFSAddress(t *testing.T) {
+	for _, tc := range []struct {
+		fsaddr, network, address, err string
+	}{
+		{fsaddr: "127.0.0.1", network: "tcp", address: "127.0.0.1:8021"},
+		{fsaddr: "fs.cgrates.org", network: "tcp", address: "fs.cgrates.org:8021"},
+		{fsaddr: "127.0.0.1:8022", network: "tcp", address: "127.0.0.1:8022"},
+		{fsaddr: "tcp://fs.cgrates.org:8022", network: "tcp", address: "fs.cgrates.org:8022"},
+		{fsaddr: "TLS://fs.cgrates.org", network: "tls", address: "fs.cgrates.org:8021"},
+		{fsaddr: "unix:///var/run/freeswitch/esl.sock", network: "unix", address: "/var/run/freeswitch/esl.sock"},
+		{fsaddr: "[::1]:8022", network: "tcp", address: "[::1]:8022"},
+		{fsaddr: "[::1]", network: "tcp", address: "[::1]:8021"},
+		{fsaddr: "::1", network: "tcp", address: "[::1]:8021"},
+		{fsaddr: "tls://[2001:db8::1]:8022", network: "tls", address: "[2001:db8::1]:8022"},
+		{fsaddr: "", err: "Invalid FreeSWITCH address <>: missing address"},
+		{fsaddr: "http://127.0.0.1:8021", err: "Invalid FreeSWITCH address <http://127.0.0.1:8021>: unsupported scheme <http>"},
+		{fsaddr: "127.0.0.1:port", err: "Invalid FreeSWITCH address <127.0.0.1:port>: invalid port <port>"},
+		{fsaddr: "127.0.0.1:0", err: "Invalid FreeSWITCH address <127.0.0.1:0>: invalid port <0>"},
+		{fsaddr: ":8021", err: "Invalid FreeSWITCH address <:8021>: invalid host <>"},
+		{fsaddr: "not an/address", err: "Invalid FreeSWITCH address <not an/address>: invalid host <not an/address>"},
+		{fsaddr: "[::1]:port", err: "Invalid FreeSWITCH address <[::1]:port>: invalid port <port>"},
+		{fsaddr: "[::1", err: "Invalid FreeSWITCH address <[::1>: address [::1: missing ']' in address"},
+	} {
+		network, address, err := parseFSAddress(tc.fsaddr)
+		if tc.err != "" {
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("<%s>: %s", tc.fsaddr, err)
+		} else if network != tc.network || address != tc.address {
+			t.Errorf("\nExpected: <%s %s>, \nReceived: <%s %s>", tc.network, tc.address, network, address)
+		}
+	}
+}
+
+func TestUtilsParseFSTable(t *testing.T) {
+	sofiaStatus := "                     Name\t          Type\t                                       Data\tState\n" +
+		"=================================================================================================\n" +
+		"            external-ipv6\t       profile\t                  sip:mod_sofia@[::1]:5080\tRUNNING (0)\n" +
+		"               172.16.0.1\t         alias\t                                   internal\tALIASED\n" +
+		"                 external\t       profile\t                sip:mod_sofia@1.2.3.4:5080\tRUNNING (0)\n" +
+		"    external::example.com\t       gateway\t                    sip:joeuser@example.com\tNOREG\n" +
+		"                 internal\t       profile\t                sip:mod_sofia@1.2.3.4:5060\tRUNNING (0)\n" +
+		"=================================================================================================\n" +
+		"4 profiles 1 alias\n"
+	expected := []map[string]string{
+		{"Name": "external-ipv6", "Type": "profile", "Data": "sip:mod_sofia@[::1]:5080", "State": "RUNNING (0)"},
+		{"Name": "172.16.0.1", "Type": "alias", "Data": "internal", "State": "ALIASED"},
+		{"Name": "external", "Type": "profile", "Data": "sip:mod_sofia@1.2.3.4:5080", "State": "RUNNING (0)"},
+		{"Name": "external::example.com", "Type": "gateway", "Data": "sip:joeuser@example.com", "State": "NOREG"},
+		{"Name": "internal", "Type": "profile", "Data": "sip:mod_sofia@1.2.3.4:5060", "State": "RUNNING (0)"},
+	}
+	if rcv := ParseFSTable(sofiaStatus); !reflect.DeepEqual(expected, rcv) {
+		t.Errorf("\nExpected: %s, \nReceived: %s", toJSON(expected), toJSON(rcv))
+	}
+}
+
+func TestUtilsParseFSTableNoTable(t *testing.T) {
+	for _, body := range []string{"", "+OK\n", "=====\nno header\n"} {
+		if rcv := ParseFSTable(body); len(rcv) != 0 {
+			t.Errorf("\nExpected empty table for %q, \nReceived: %s", body, toJSON(rcv))
+		}
+	}
+}
+
+func TestUtilsParseJobUUID(t *testing.T) {
+	for rplyTxt, expected := range map[string]string{
+		"+OK Job-UUID: 5ac5a2a4-0b5d-4c4d-9a0e-16f3c0e3f8f3":   "5ac5a2a4-0b5d-4c4d-9a0e-16f3c0e3f8f3",
+		"+OK Job-UUID:5ac5a2a4-0b5d-4c4d-9a0e-16f3c0e3f8f3":    "5ac5a2a4-0b5d-4c4d-9a0e-16f3c0e3f8f3",
+		"+OK Job-UUID: 5ac5a2a4-0b5d-4c4d-9a0e-16f3c0e3f8f3\n": "5ac5a2a4-0b5d-4c4d-9a0e-16f3c0e3f8f3",
+		"+OK Job-UUID: ": "",
+		"+OK":            "",
+		"-ERR no reply":  "",
+		"":               "",
+	} {
+		if rcv := parseJobUUID(rplyTxt); rcv != expected {
+			t.Errorf("For %q\nExpected: <%+v>, \nReceived: <%+v>", rplyTxt, expected, rcv)
+		}
+	}
+}
+
+func TestUtilsHeaderValCaseInsensitive(t *testing.T) {
+	hdrs := "content-type: text/event-plain\nCONTENT-LENGTH: 42\nX-Note: Event-Name: fake\nEvent-name: HEARTBEAT\n\nContent-Disposition: body\n"
+	for hdr, expected := range map[string]string{
+		"Content-Type":        "text/event-plain",
+		"Content-Length":      "42",
+		"content-length":      "42",
+		"Event-Name":          "HEARTBEAT", // not from the X-Note value
+		"Content":             "",
+		"Content-Disposition": "", // after the headers
+	} {
+		if rcv := headerVal(hdrs, hdr); rcv != expected {
+			t.Errorf("For %s\nExpected: <%+v>, \nReceived: <%+v>", hdr, expected, rcv)
+		}
+	}
+	if _, has := headerValue(hdrs, "Content"); has {
+		t.Error("expected partial header names not to match")
+	}
+}
+
+func TestUtilsParseHeaderLineAgreement(t *testing.T) {
+	hdrs := "variable_sip_req_uri: sip:1001@10.0.0.1:5060\r\n" +
+		"X-Note: Event-Name: fake\n" +
+		"Caller-Caller-ID-Name:  Dan%20Ionescu  \n" +
+		"variable_dialed:sofia/internal/1002\n" +
+		"Empty-Value:\n"
+	fsMap := FSEventStrToMap(hdrs, nil)
+	evMap := EventToMap(hdrs)
+	for hdr, expected := range map[string]string{
+		"variable_sip_req_uri":  "sip:1001@10.0.0.1:5060",
+		"X-Note":                "Event-Name: fake",
+		"Caller-Caller-ID-Name": "Dan Ionescu",
+		"variable_dialed":       "sofia/internal/1002",
+		"Empty-Value":           "",
+	} {
+		if rcv := urlDecode(headerVal(hdrs, hdr)); rcv != expected {
+			t.Errorf("headerVal %s\nExpected: <%+v>, \nReceived: <%+v>", hdr, expected, rcv)
+		}
+		if rcv, has := fsMap[hdr]; !has || rcv != expected {
+			t.Errorf("FSEventStrToMap %s\nExpected: <%+v>, \nReceived: <%+v>", hdr, expected, rcv)
+		}
+		if rcv, has := evMap[hdr]; !has || rcv != expected {
+			t.Errorf("EventToMap %s\nExpected: <%+v>, \nReceived: <%+v>", hdr, expected, rcv)
+		}
+	}
+	if _, has := fsMap["Event-Name"]; has {
+		t.Error("unexpected header parsed out of a value")
+	}
+	if key, val, ok := parseHeaderLine("no colon here\r"); ok || key != "no colon here" || val != "" {
+		t.Errorf("unexpected parse of line without colon: %q %q %v", key, val, ok)
+	}
+}
+
+func TestUtilsStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	var l Logger = NewStdLogger(log.New(&buf, "fsock ", 0))
+	l.Info("<FSock> Successfully connected to FreeSWITCH!")
+	l.Err("<FSock> Cannot write command to socket <EOF>")
+	l.Debug("<FSock> Sent: <api status\n\n>")
+	expected := "fsock [INFO] <FSock> Successfully connected to FreeSWITCH!\n" +
+		"fsock [ERR] <FSock> Cannot write command to socket <EOF>\n" +
+		"fsock [DEBUG] <FSock> Sent: <api status\n\n>\n"
+	if rcv := buf.String(); rcv != expected {
+		t.Errorf("\nExpected: %q, \nReceived: %q", expected, rcv)
+	}
+	if err := l.Close(); err != nil {
+		t.Error(err)
+	}
+	if sl := NewStdLogger(nil); sl.logger.Writer() != os.Stderr {
+		t.Error("expected the default logger to write to stderr")
+	}
+}
+
+func TestUtilsURLEncode(t *testing.T) {
+	for val, expected := range map[string]string{
+		"plain":                "plain",
+		"two words":            "two%20words",
+		"line1\nline2":         "line1%0Aline2",
+		"a+b=c&d 100%":         "a%2Bb%3Dc%26d%20100%25",
+		"sofia/gw/+1234@x.com": "sofia%2Fgw%2F%2B1234%40x.com",
+	} {
+		rcv := URLEncode(val)
+		if rcv != expected {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", expected, rcv)
+		}
+		if decoded := urlDecode(rcv); decoded != val {
+			t.Errorf("\nExpected: <%+v>, \nReceived: <%+v>", val, decoded)
+		}
+	}
+}
+
+func TestUtilsDecodeLatin1(t *testing.T) {
+	if rcv := DecodeLatin1("Jos\xe9 Mu\xf1oz"); rcv != "José Muñoz" {
+		t.Errorf("\nExpected: %q, \nReceived: %q", "José Muñoz", rcv)
+	}
+	if rcv := DecodeLatin1("\xc3\xa9t\xc3\xa9"); rcv != "Ã©tÃ©" { // Latin-1 bytes forming valid UTF-8
+		t.Errorf("\nExpected: %q, \nReceived: %q", "Ã©tÃ©", rcv)
+	}
+	if rcv := DecodeLatin1("Jose"); rcv != "Jose" { // ASCII unchanged
+		t.Errorf("\nExpected: %q, \nReceived: %q", "Jose", rcv)
+	}
+}